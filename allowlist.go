@@ -0,0 +1,158 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PluginAllowlist maps plugin types to the hex encoded SHA-256 hashes
+// of the binaries allowed to run for them.
+type PluginAllowlist map[string][]string
+
+// PluginIntegrityError is the error of a plugin binary whose hash is
+// not allowed for its plugin type.
+type PluginIntegrityError struct {
+	Type   string
+	Path   string
+	SHA256 string
+}
+
+func (e *PluginIntegrityError) Error() string {
+	return fmt.Sprintf("plugin %s binary %s with SHA-256 %s is not allowed", e.Type, e.Path, e.SHA256)
+}
+
+// WithPluginAllowlist can be used to only run the plugin binaries
+// whose SHA-256 hash is allowed for their plugin type. The plugin
+// types missing from the allowlist can not run. A refused binary
+// fails with a *PluginIntegrityError.
+//
+// On Linux, the default executor runs the binary it has hashed, through
+// its file descriptor, so replacing the binary after it was checked has
+// no effect. Elsewhere, and with the executors of WithNetworkPlugins,
+// the binary is run by path once checked, so the plugin directories
+// must only be writable by trusted users.
+func WithPluginAllowlist(allowlist PluginAllowlist) Opt {
+	return func(c *libcni) error {
+		hashes := make(map[string][]string, len(allowlist))
+		for pluginType, sums := range allowlist {
+			for _, sum := range sums {
+				sum = strings.ToLower(sum)
+				if b, err := hex.DecodeString(sum); err != nil || len(b) != 32 {
+					return fmt.Errorf("invalid SHA-256 %q for plugin %s: %w", sum, pluginType, ErrInvalidConfig)
+				}
+				hashes[pluginType] = append(hashes[pluginType], sum)
+			}
+		}
+		c.pluginAllowlist = &pluginAllowlist{
+			hashes:   hashes,
+			verified: make(map[string]verifiedBinary),
+		}
+		return nil
+	}
+}
+
+// WithPluginAllowlistFile can be used to load the plugin allowlist
+// of WithPluginAllowlist from a JSON file, mapping plugin types to
+// arrays of hashes.
+func WithPluginAllowlistFile(path string) Opt {
+	return func(c *libcni) error {
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read plugin allowlist: %v: %w", err, ErrRead)
+		}
+		var allowlist PluginAllowlist
+		if err := json.Unmarshal(bytes, &allowlist); err != nil {
+			return fmt.Errorf("invalid plugin allowlist %s: %v: %w", path, err, ErrInvalidConfig)
+		}
+		return WithPluginAllowlist(allowlist)(c)
+	}
+}
+
+// pluginAllowlist checks the plugin binaries against the allowed
+// hashes. The hashes of the binaries are cached by path, and hashed
+// again when their inode, size or modification time change.
+type pluginAllowlist struct {
+	hashes map[string][]string
+
+	mu       sync.Mutex
+	verified map[string]verifiedBinary
+}
+
+type verifiedBinary struct {
+	inode   uint64
+	size    int64
+	modTime time.Time
+	sha256  string
+}
+
+// open opens the binary at path, and returns it if it is allowed for
+// its plugin type, or a *PluginIntegrityError. The binary is hashed
+// through the returned file, so that running the file runs the binary
+// that was verified even if path is replaced in between.
+func (a *pluginAllowlist) open(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.verify(path, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// verify returns a *PluginIntegrityError if the binary f opened at path
+// is not allowed for its plugin type.
+func (a *pluginAllowlist) verify(path string, f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	current := verifiedBinary{
+		inode:   fileInode(fi),
+		size:    fi.Size(),
+		modTime: fi.ModTime(),
+	}
+
+	a.mu.Lock()
+	cached, ok := a.verified[path]
+	a.mu.Unlock()
+	if ok && cached.inode == current.inode && cached.size == current.size && cached.modTime.Equal(current.modTime) {
+		current.sha256 = cached.sha256
+	} else {
+		if current.sha256, err = readerSHA256(f); err != nil {
+			return err
+		}
+		a.mu.Lock()
+		a.verified[path] = current
+		a.mu.Unlock()
+	}
+
+	pluginType := pluginTypeFromPath(path)
+	if !slices.Contains(a.hashes[pluginType], current.sha256) {
+		return &PluginIntegrityError{Type: pluginType, Path: path, SHA256: current.sha256}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPluginAllowlist(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake plugins are shell scripts")
+	}
+
+	pluginDir := t.TempDir()
+	plugin := []byte("#!/bin/sh\necho \"$0\" > \"$ARGV0_FILE\"\necho '{\"cniVersion\": \"1.0.0\", \"supportedVersions\": [\"1.0.0\"]}'\n")
+	bridge := filepath.Join(pluginDir, "bridge")
+	assert.NoError(t, os.WriteFile(bridge, plugin, 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(pluginDir, "portmap"), plugin, 0o755))
+	sum := sha256.Sum256(plugin)
+	allowed := hex.EncodeToString(sum[:])
+
+	allowlistFile := filepath.Join(t.TempDir(), "allowlist.json")
+	assert.NoError(t, os.WriteFile(allowlistFile, []byte(`{"bridge": ["`+allowed+`"]}`), 0o644))
+
+	argv0File := filepath.Join(t.TempDir(), "argv0")
+	c, err := New(WithPluginAllowlistFile(allowlistFile), WithPluginDir([]string{pluginDir}),
+		WithPluginEnv(PluginEnv{Set: map[string]string{"ARGV0_FILE": argv0File}}))
+	assert.NoError(t, err)
+	l := c.(*libcni)
+	ctx := context.Background()
+
+	info, err := l.cniConfig.GetVersionInfo(ctx, "bridge")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1.0.0"}, info.SupportedVersions())
+	if runtime.GOOS == "linux" {
+		// The binary that was hashed is run through its descriptor.
+		argv0, err := os.ReadFile(argv0File)
+		assert.NoError(t, err)
+		assert.Equal(t, "/proc/self/fd/3\n", string(argv0))
+	}
+
+	// The plugin types missing from the allowlist are refused.
+	_, err = l.cniConfig.GetVersionInfo(ctx, "portmap")
+	var integrityErr *PluginIntegrityError
+	if assert.True(t, errors.As(err, &integrityErr)) {
+		assert.Equal(t, "portmap", integrityErr.Type)
+		assert.Equal(t, allowed, integrityErr.SHA256)
+	}
+
+	// An unchanged binary is not hashed again.
+	verified := l.pluginAllowlist.verified[bridge]
+	verified.sha256 = "cached"
+	l.pluginAllowlist.verified[bridge] = verified
+	_, err = l.cniConfig.GetVersionInfo(ctx, "bridge")
+	assert.True(t, errors.As(err, &integrityErr))
+	assert.Equal(t, "cached", integrityErr.SHA256)
+
+	// A modified binary is hashed again and refused.
+	assert.NoError(t, os.WriteFile(bridge, append(plugin, "# tampered\n"...), 0o755))
+	_, err = l.cniConfig.GetVersionInfo(ctx, "bridge")
+	if assert.True(t, errors.As(err, &integrityErr)) {
+		assert.Equal(t, "bridge", integrityErr.Type)
+		assert.Equal(t, bridge, integrityErr.Path)
+		assert.NotEqual(t, allowed, integrityErr.SHA256)
+	}
+
+	_, err = New(WithPluginAllowlist(PluginAllowlist{"bridge": {"not-a-hash"}}))
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
@@ -0,0 +1,184 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	cnilibrary "github.com/containernetworking/cni/libcni"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// Attachment is a network attachment recorded by libcni in the
+// cni cache directory after a successful ADD.
+type Attachment struct {
+	ContainerID    string
+	Network        string
+	IfName         string
+	NetNS          string
+	Args           [][2]string
+	CapabilityArgs map[string]interface{}
+	// Config is the network config list the attachment was created with.
+	// It is nil if the cached config could not be parsed.
+	Config *NetworkConfList
+	// Result is the cached result of the ADD. It is nil if the cached
+	// result could not be read or converted.
+	Result *types100.Result
+	// Loaded is true if a network with the same name is part of the
+	// currently loaded configuration. Attachments that are not loaded
+	// are orphans whose network no longer exists.
+	Loaded bool
+
+	config *cnilibrary.NetworkConfigList
+}
+
+// Attachments returns all the network attachments recorded in the
+// cni cache directory, cross-referenced against the loaded networks.
+func (c *libcni) Attachments() ([]*Attachment, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.attachments("")
+}
+
+// attachments returns the cached attachments, filtered by containerID
+// if it is not empty.
+func (c *libcni) attachments(containerID string) ([]*Attachment, error) {
+	cached, err := c.cniConfig.GetCachedAttachments(containerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached attachments: %v: %w", err, ErrRead)
+	}
+	loaded := make(map[string]bool, len(c.networks))
+	for _, network := range c.networks {
+		loaded[network.config.Name] = true
+	}
+	var attachments []*Attachment
+	for _, ca := range cached {
+		a := &Attachment{
+			ContainerID:    ca.ContainerID,
+			Network:        ca.Network,
+			IfName:         ca.IfName,
+			NetNS:          ca.NetNS,
+			Args:           ca.CniArgs,
+			CapabilityArgs: ca.CapabilityArgs,
+			Loaded:         loaded[ca.Network],
+		}
+		if confList, err := confListFromCache(ca.Config); err == nil {
+			a.config = confList
+			a.Config = newNetworkConfList(confList)
+			a.Result, _ = cachedResult(c.cniConfig, confList, a.runtimeConf())
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+// RemoveByID removes every network recorded as attached to the container
+// id in the cni cache directory. The networks are removed with the config
+// and runtime config they were attached with, so neither the network
+// namespace nor the original options are needed. A network namespace
+// that no longer exists is not an error.
+func (c *libcni) RemoveByID(ctx context.Context, id string) error {
+	c.RLock()
+	defer c.RUnlock()
+	if id == "" {
+		return fmt.Errorf("container id is required: %w", ErrInvalidConfig)
+	}
+	attachments, err := c.attachments(id)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, a := range attachments {
+		if err := c.removeAttachment(ctx, a); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// removeAttachment runs DEL for the attachment with its cached config.
+// The network namespace is omitted if it no longer exists.
+func (c *libcni) removeAttachment(ctx context.Context, a *Attachment) error {
+	if a.config == nil {
+		return fmt.Errorf("no cached config for %s on network %s: %w", a.ContainerID, a.Network, ErrInvalidConfig)
+	}
+	rt := a.runtimeConf()
+	if rt.NetNS != "" && !pathExists(rt.NetNS) {
+		rt.NetNS = ""
+	}
+	if err := c.networkCNI(a.Network).DelNetworkList(ctx, a.config, rt); err != nil {
+		return fmt.Errorf("failed to remove %s from network %s: %w", a.ContainerID, a.Network, err)
+	}
+	return nil
+}
+
+// networkCNI returns the cnilibrary.CNI of the loaded network called name,
+// or the default one if no such network is loaded.
+func (c *libcni) networkCNI(name string) cnilibrary.CNI {
+	for _, network := range c.networks {
+		if network.config.Name == name {
+			return network.cni
+		}
+	}
+	return c.cniConfig
+}
+
+// cachedResult returns the result libcni cached for the network and
+// runtime config, converted to the 1.0.0 result type.
+func cachedResult(cni cnilibrary.CNI, confList *cnilibrary.NetworkConfigList, rt *cnilibrary.RuntimeConf) (*types100.Result, error) {
+	r, err := cni.GetNetworkListCachedResult(confList, rt)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, fmt.Errorf("no cached result for network %s: %w", confList.Name, ErrNotFound)
+	}
+	return types100.NewResultFromResult(r)
+}
+
+// runtimeConf returns the runtime config the attachment was created with.
+func (a *Attachment) runtimeConf() *cnilibrary.RuntimeConf {
+	return &cnilibrary.RuntimeConf{
+		ContainerID:    a.ContainerID,
+		NetNS:          a.NetNS,
+		IfName:         a.IfName,
+		Args:           a.Args,
+		CapabilityArgs: a.CapabilityArgs,
+	}
+}
+
+// confListFromCache parses the config cached for an attachment, which is
+// either a network config list or a single network config.
+func confListFromCache(bytes []byte) (*cnilibrary.NetworkConfigList, error) {
+	confList, err := cnilibrary.ConfListFromBytes(bytes)
+	if err == nil && len(confList.Plugins) > 0 {
+		return confList, nil
+	}
+	conf, err := confFromBytes(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cached config: %v: %w", err, ErrInvalidConfig)
+	}
+	return confListFromConf(conf)
+}
+
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
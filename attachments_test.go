@@ -0,0 +1,96 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	cnilibrary "github.com/containernetworking/cni/libcni"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAttachments(t *testing.T) {
+	t.Parallel()
+
+	cacheDir := t.TempDir()
+	netNS1, netNS2 := filepath.Join(t.TempDir(), "netns1"), filepath.Join(t.TempDir(), "netns2")
+	writeFakeCachedAttachment(t, cacheDir, "plugin1", "container-id1", "eth0", netNS1, "10.0.0.1/24")
+	writeFakeCachedAttachment(t, cacheDir, "removed-net", "container-id2", "eth1", netNS2, "10.0.1.1/24")
+
+	_, confDir := makeFakeCNIConfig(t)
+	c, err := New(WithPluginConfDir(confDir), WithCacheDir(cacheDir))
+	assert.NoError(t, err)
+	assert.NoError(t, c.Load(WithAllConf))
+	assert.Equal(t, cacheDir, c.GetConfig().CacheDir)
+
+	attachments, err := c.(AttachmentLister).Attachments()
+	assert.NoError(t, err)
+	assert.Len(t, attachments, 2)
+
+	a := attachments[0]
+	assert.Equal(t, "plugin1", a.Network)
+	assert.Equal(t, "container-id1", a.ContainerID)
+	assert.Equal(t, "eth0", a.IfName)
+	assert.Equal(t, netNS1, a.NetNS)
+	assert.True(t, a.Loaded)
+	assert.NotNil(t, a.Config)
+	assert.Equal(t, "plugin1", a.Config.Name)
+	if assert.NotNil(t, a.Result) && assert.Len(t, a.Result.IPs, 1) {
+		assert.Equal(t, "10.0.0.1", a.Result.IPs[0].Address.IP.String())
+	}
+
+	a = attachments[1]
+	assert.Equal(t, "removed-net", a.Network)
+	assert.Equal(t, "container-id2", a.ContainerID)
+	assert.False(t, a.Loaded)
+}
+
+func TestRemoveByID(t *testing.T) {
+	t.Parallel()
+
+	cacheDir := t.TempDir()
+	goneNetNS, netNS := filepath.Join(t.TempDir(), "gone"), filepath.Join(t.TempDir(), "netns")
+	writeFakeCachedAttachment(t, cacheDir, "plugin1", "container-id1", "eth0", goneNetNS, "10.0.0.1/24")
+	writeFakeCachedAttachment(t, cacheDir, "plugin2", "container-id1", "eth1", goneNetNS, "10.0.1.1/24")
+	writeFakeCachedAttachment(t, cacheDir, "plugin1", "container-id2", "eth0", netNS, "10.0.0.2/24")
+
+	l := defaultCNIConfig()
+	_, confDir := makeFakeCNIConfig(t)
+	l.pluginConfDir = confDir
+	assert.NoError(t, l.Load(WithCacheDir(cacheDir), WithAllConf))
+
+	mockCNI := &MockCNI{}
+	l.networks[0].cni = mockCNI
+	l.networks[1].cni = mockCNI
+	// The network namespace is gone, so it is omitted from DEL.
+	mockCNI.On("DelNetworkList", mock.Anything, &cnilibrary.RuntimeConf{
+		ContainerID: "container-id1",
+		IfName:      "eth0",
+	}).Return(nil)
+	mockCNI.On("DelNetworkList", mock.Anything, &cnilibrary.RuntimeConf{
+		ContainerID: "container-id1",
+		IfName:      "eth1",
+	}).Return(nil)
+
+	err := l.RemoveByID(context.Background(), "container-id1")
+	assert.NoError(t, err)
+	mockCNI.AssertExpectations(t)
+	mockCNI.AssertNumberOfCalls(t, "DelNetworkList", 2)
+}
@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
@@ -47,17 +48,69 @@ type CNI interface {
 	GetConfig() *ConfigResult
 }
 
+// AttachmentLister is implemented by the CNI returned by New, and lists
+// the network attachments recorded in the cni cache directory.
+type AttachmentLister interface {
+	Attachments() ([]*Attachment, error)
+}
+
+// AttachmentRemover is implemented by the CNI returned by New, and tears
+// down every network cached as attached to a container.
+type AttachmentRemover interface {
+	RemoveByID(ctx context.Context, id string) error
+}
+
+// SandboxReconciler is implemented by the CNI returned by New, and
+// removes the attachments of the sandboxes that are no longer alive.
+type SandboxReconciler interface {
+	Reconcile(ctx context.Context, liveSandboxes LiveSandboxesFunc) (*ReconcileReport, error)
+}
+
+// PluginInspector is implemented by the CNI returned by New, and
+// inventories the plugin binaries used by the loaded networks.
+type PluginInspector interface {
+	PluginInventory(ctx context.Context) ([]*PluginInfo, error)
+}
+
 type ConfigResult struct {
 	PluginDirs       []string
 	PluginConfDir    string
+	PluginConfDirs   []string
+	CacheDir         string
 	PluginMaxConfNum int
 	Prefix           string
-	Networks         []*ConfNetwork
+	// DefaultNetwork is the name of the network attached on the
+	// default interface.
+	DefaultNetwork string
+	Networks       []*ConfNetwork
+	// Plugins are the plugin types of the loaded networks, and where
+	// their binaries were found by the last load.
+	Plugins []*PluginResolution
+	// Warnings are the network config files and networks skipped by
+	// the last load.
+	Warnings []*ConfWarning
+}
+
+// ConfWarning describes a network config file or network skipped on
+// load. File is empty for the networks not loaded from a file.
+type ConfWarning struct {
+	File   string
+	Reason string
 }
 
 type ConfNetwork struct {
-	Config *NetworkConfList
-	IFName string
+	// Config is the effective network config list, and Original the
+	// config list as loaded, before patches were applied.
+	Config   *NetworkConfList
+	Original *NetworkConfList
+	IFName   string
+	// PluginDirs are the directories the plugins of the network are
+	// found in.
+	PluginDirs []string
+	// ConfDir and ConfFile are the directory and file the network was
+	// loaded from. They are empty for networks not loaded from a file.
+	ConfDir  string
+	ConfFile string
 }
 
 // NetworkConfList is a source bytes to string version of cnilibrary.NetworkConfigList
@@ -80,6 +133,15 @@ type libcni struct {
 	cniConfig    cnilibrary.CNI
 	networkCount int // minimum network plugin configurations needed to initialize cni
 	networks     []*Network
+	warnings     []*ConfWarning
+	// defaultIfName is the interface name of the default network.
+	defaultIfName string
+	// plugins are the plugin types of the loaded networks, resolved
+	// when the networks are loaded.
+	plugins []*PluginResolution
+	// loCNIVersions caches the CNI version of the default loopback
+	// network config by loopback plugin binary.
+	loCNIVersions map[string]cachedLoCNIVersion
 	// Mutex contract:
 	// - lock in public methods: write lock when mutating the state, read lock when reading the state.
 	// - never lock in private methods.
@@ -87,24 +149,43 @@ type libcni struct {
 }
 
 func defaultCNIConfig() *libcni {
-	return &libcni{
+	c := &libcni{
 		config: config{
 			pluginDirs:       []string{DefaultCNIDir},
 			pluginConfDir:    DefaultNetDir,
 			pluginMaxConfNum: DefaultMaxConfNum,
 			prefix:           DefaultPrefix,
+			cleanupTimeout:   DefaultCleanupTimeout,
 		},
-		cniConfig: cnilibrary.NewCNIConfig(
-			[]string{
-				DefaultCNIDir,
-			},
-			&invoke.DefaultExec{
-				RawExec:       &invoke.RawExec{Stderr: os.Stderr},
-				PluginDecoder: version.PluginDecoder{},
-			},
-		),
 		networkCount: 1,
 	}
+	c.cniConfig = c.newCNIConfig()
+	return c
+}
+
+// newCNIConfig creates the cnilibrary.CNI used to invoke plugins found
+// in the plugin directories. An empty cacheDir selects the libcni default.
+func (c *config) newCNIConfig() cnilibrary.CNI {
+	return c.newNetworkCNIConfig(c.pluginDirs, nil, nil)
+}
+
+// newNetworkCNIConfig creates the cnilibrary.CNI used to invoke plugins
+// found in dirs with exec and the environment env, set after the global
+// one. A nil exec selects the default executor.
+func (c *config) newNetworkCNIConfig(dirs []string, exec invoke.Exec, env *PluginEnv) cnilibrary.CNI {
+	defaultExec := exec == nil
+	if defaultExec {
+		exec = &invoke.DefaultExec{
+			RawExec:       &invoke.RawExec{Stderr: os.Stderr},
+			PluginDecoder: version.PluginDecoder{},
+		}
+	}
+	return cnilibrary.NewCNIConfigWithCacheDir(dirs, c.cacheDir, &pluginExec{
+		Exec:        exec,
+		config:      c,
+		env:         env,
+		defaultExec: defaultExec,
+	})
 }
 
 // New creates a new libcni instance.
@@ -116,6 +197,9 @@ func New(config ...Opt) (CNI, error) {
 			return nil, err
 		}
 	}
+	if err = cni.processNetworks(); err != nil {
+		return nil, err
+	}
 	return cni, nil
 }
 
@@ -133,6 +217,72 @@ func (c *libcni) Load(opts ...Opt) error {
 			return fmt.Errorf("cni config load failed: %v: %w", err, ErrLoad)
 		}
 	}
+	if err = c.processNetworks(); err != nil {
+		return fmt.Errorf("cni config load failed: %v: %w", err, ErrLoad)
+	}
+	return nil
+}
+
+// processNetworks applies the configured modifications to the loaded
+// networks and checks the result.
+func (c *libcni) processNetworks() error {
+	if err := c.injectPlugins(); err != nil {
+		return err
+	}
+	if err := c.patchNetworks(); err != nil {
+		return err
+	}
+	if err := c.overrideCNIVersions(); err != nil {
+		return err
+	}
+	if err := c.checkNetworks(); err != nil {
+		return err
+	}
+	c.defaultIfName = c.findDefaultIfName()
+	c.plugins = c.resolvePlugins()
+	return nil
+}
+
+// findDefaultIfName returns the interface name of the default network,
+// the first network that is not the loopback one.
+func (c *libcni) findDefaultIfName() string {
+	for _, network := range c.networks {
+		if network.ifName != loopbackIfName {
+			return network.ifName
+		}
+	}
+	return defaultInterface(c.prefix)
+}
+
+// checkNetworks checks that the loaded networks have unique names and
+// interface names, and that the interface names fit IFNAMSIZ. With
+// deduplication enabled the duplicates are dropped instead.
+func (c *libcni) checkNetworks() error {
+	names := make(map[string]*Network, len(c.networks))
+	ifNames := make(map[string]*Network, len(c.networks))
+	networks := c.networks[:0]
+	for _, network := range c.networks {
+		if len(network.ifName) > MaxIfNameLen {
+			return fmt.Errorf("interface name %s of network %s is longer than %d bytes: %w", network.ifName, network.config.Name, MaxIfNameLen, ErrInvalidConfig)
+		}
+		var err error
+		if other, ok := names[network.config.Name]; ok {
+			err = fmt.Errorf("network %s%s is already defined%s: %w", network.config.Name, network.source(), other.source(), ErrInvalidConfig)
+		} else if other, ok := ifNames[network.ifName]; ok {
+			err = fmt.Errorf("interface name %s of network %s%s is already used by network %s%s: %w", network.ifName, network.config.Name, network.source(), other.config.Name, other.source(), ErrInvalidConfig)
+		}
+		if err != nil {
+			if !c.deduplicateNetworks {
+				return err
+			}
+			c.warnings = append(c.warnings, &ConfWarning{File: network.confFile, Reason: err.Error()})
+			continue
+		}
+		names[network.config.Name] = network
+		ifNames[network.ifName] = network
+		networks = append(networks, network)
+	}
+	c.networks = networks
 	return nil
 }
 
@@ -143,9 +293,14 @@ func (c *libcni) Status() error {
 	if err := c.ready(); err != nil {
 		return err
 	}
+	if c.checkPlugins {
+		if _, err := c.pluginInventory(context.Background(), false); err != nil {
+			return err
+		}
+	}
 	// STATUS is only called for CNI Version 1.1.0 or greater. It is ignored for previous versions.
 	for _, v := range c.networks {
-		err := c.cniConfig.GetStatusNetworkList(context.Background(), v.config)
+		err := v.cni.GetStatusNetworkList(context.Background(), v.config)
 
 		if err != nil {
 			return err
@@ -201,9 +356,12 @@ func (c *libcni) SetupSerially(ctx context.Context, id string, path string, opts
 
 func (c *libcni) attachNetworksSerially(ctx context.Context, ns *Namespace) ([]*types100.Result, error) {
 	var results []*types100.Result
-	for _, network := range c.networks {
-		r, err := network.Attach(ctx, ns)
+	for i, network := range c.networks {
+		r, err := c.attach(ctx, network, ns)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil, c.cleanupCancelledSetup(ctx, c.networks[:i+1], ns, err)
+			}
 			return nil, err
 		}
 		results = append(results, r)
@@ -211,15 +369,30 @@ func (c *libcni) attachNetworksSerially(ctx context.Context, ns *Namespace) ([]*
 	return results, nil
 }
 
+// attach attaches the network to the namespace. With idempotent setup
+// enabled an existing attachment is verified and returned instead.
+func (c *libcni) attach(ctx context.Context, n *Network, ns *Namespace) (*types100.Result, error) {
+	if c.idempotentSetup {
+		r, err := n.reuse(ctx, ns)
+		if err == nil {
+			return r, nil
+		}
+		if !IsNotFound(err) {
+			return nil, fmt.Errorf("failed to verify existing attachment to network %s: %w", n.config.Name, err)
+		}
+	}
+	return n.Attach(ctx, ns)
+}
+
 type asynchAttachResult struct {
 	index int
 	res   *types100.Result
 	err   error
 }
 
-func asynchAttach(ctx context.Context, index int, n *Network, ns *Namespace, wg *sync.WaitGroup, rc chan asynchAttachResult) {
+func (c *libcni) asynchAttach(ctx context.Context, index int, n *Network, ns *Namespace, wg *sync.WaitGroup, rc chan asynchAttachResult) {
 	defer wg.Done()
-	r, err := n.Attach(ctx, ns)
+	r, err := c.attach(ctx, n, ns)
 	rc <- asynchAttachResult{index: index, res: r, err: err}
 }
 
@@ -231,7 +404,7 @@ func (c *libcni) attachNetworks(ctx context.Context, ns *Namespace) ([]*types100
 
 	for i, network := range c.networks {
 		wg.Add(1)
-		go asynchAttach(ctx, i, network, ns, &wg, rc)
+		go c.asynchAttach(ctx, i, network, ns, &wg, rc)
 	}
 
 	for range c.networks {
@@ -243,9 +416,31 @@ func (c *libcni) attachNetworks(ctx context.Context, ns *Namespace) ([]*types100
 	}
 	wg.Wait()
 
+	if firstError != nil && ctx.Err() != nil {
+		return nil, c.cleanupCancelledSetup(ctx, c.networks, ns, firstError)
+	}
 	return results, firstError
 }
 
+// cleanupCancelledSetup removes the networks a Setup has attached or
+// partially attached before its context was cancelled. The networks are
+// removed with a context detached from ctx, bounded by the cleanup
+// timeout. The returned error wraps the cancellation cause of ctx.
+func (c *libcni) cleanupCancelledSetup(ctx context.Context, networks []*Network, ns *Namespace, setupErr error) error {
+	cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.cleanupTimeout)
+	defer cancel()
+	var removed, failed []string
+	for _, network := range networks {
+		if err := network.Remove(cleanupCtx, ns); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", network.config.Name, err))
+			continue
+		}
+		removed = append(removed, network.config.Name)
+	}
+	return fmt.Errorf("setup cancelled: %v: cleaned up networks %v, failed to clean up networks %v: %w",
+		setupErr, removed, failed, context.Cause(ctx))
+}
+
 // Remove removes the network config from the namespace
 func (c *libcni) Remove(ctx context.Context, id string, path string, opts ...NamespaceOpts) error {
 	c.RLock()
@@ -304,31 +499,62 @@ func (c *libcni) GetConfig() *ConfigResult {
 	r := &ConfigResult{
 		PluginDirs:       c.config.pluginDirs,
 		PluginConfDir:    c.config.pluginConfDir,
+		PluginConfDirs:   c.config.confDirs(),
+		CacheDir:         c.config.cacheDir,
 		PluginMaxConfNum: c.config.pluginMaxConfNum,
 		Prefix:           c.config.prefix,
 	}
+	for _, w := range c.warnings {
+		r.Warnings = append(r.Warnings, &ConfWarning{File: w.File, Reason: w.Reason})
+	}
 	for _, network := range c.networks {
-		conf := &NetworkConfList{
-			Name:       network.config.Name,
-			CNIVersion: network.config.CNIVersion,
-			Source:     string(network.config.Bytes),
+		if network.ifName == c.defaultIfName {
+			r.DefaultNetwork = network.config.Name
 		}
-		for _, plugin := range network.config.Plugins {
-			conf.Plugins = append(conf.Plugins, &NetworkConf{
-				Network: plugin.Network,
-				Source:  string(plugin.Bytes),
-			})
+		n := &ConfNetwork{
+			Config:     newNetworkConfList(network.config),
+			Original:   newNetworkConfList(network.config),
+			IFName:     network.ifName,
+			PluginDirs: c.networkPluginDirs(network),
+			ConfFile:   network.confFile,
 		}
-		r.Networks = append(r.Networks, &ConfNetwork{
-			Config: conf,
-			IFName: network.ifName,
-		})
+		if network.origConfig != nil {
+			n.Original = newNetworkConfList(network.origConfig)
+		}
+		if network.confFile != "" {
+			n.ConfDir = filepath.Dir(network.confFile)
+		}
+		r.Networks = append(r.Networks, n)
+	}
+	for _, p := range c.plugins {
+		resolution := *p
+		r.Plugins = append(r.Plugins, &resolution)
 	}
 	return r
 }
 
+// newNetworkConfList converts a cnilibrary.NetworkConfigList into its
+// source string representation.
+func newNetworkConfList(confList *cnilibrary.NetworkConfigList) *NetworkConfList {
+	conf := &NetworkConfList{
+		Name:       confList.Name,
+		CNIVersion: confList.CNIVersion,
+		Source:     string(confList.Bytes),
+	}
+	for _, plugin := range confList.Plugins {
+		conf.Plugins = append(conf.Plugins, &NetworkConf{
+			Network: plugin.Network,
+			Source:  string(plugin.Bytes),
+		})
+	}
+	return conf
+}
+
 func (c *libcni) reset() {
 	c.networks = nil
+	c.warnings = nil
+	c.defaultIfName = ""
+	c.plugins = nil
 }
 
 func (c *libcni) ready() error {
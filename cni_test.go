@@ -18,9 +18,16 @@ package cni
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
 
 	cnilibrary "github.com/containernetworking/cni/libcni"
 	"github.com/containernetworking/cni/pkg/types"
@@ -302,7 +309,8 @@ func TestLibCNIType120(t *testing.T) {
 	l.pluginConfDir = confDir
 	// Set the minimum network count as 2 for this test
 	l.networkCount = 2
-	err := l.Load(WithLoNetwork, WithDefaultConf)
+	// No loopback plugin is found, so it is not run.
+	err := l.Load(WithPluginDir([]string{t.TempDir()}), WithLoNetwork, WithDefaultConf)
 	assert.NoError(t, err)
 
 	mockCNI := &MockCNI{}
@@ -395,7 +403,8 @@ func TestLibCNIType120FailStatus(t *testing.T) {
 	l.pluginConfDir = confDir
 	// Set the minimum network count as 2 for this test
 	l.networkCount = 2
-	err := l.Load(WithLoNetwork, WithDefaultConf)
+	// No loopback plugin is found, so it is not run.
+	err := l.Load(WithPluginDir([]string{t.TempDir()}), WithLoNetwork, WithDefaultConf)
 	assert.NoError(t, err)
 
 	mockCNI := &MockCNI{}
@@ -410,6 +419,796 @@ func TestLibCNIType120FailStatus(t *testing.T) {
 	assert.Error(t, err)
 }
 
+// TestLibCNIIdempotentSetup tests that Setup reuses the existing
+// attachments and only runs ADD for the missing networks
+func TestLibCNIIdempotentSetup(t *testing.T) {
+	t.Parallel()
+
+	l := defaultCNIConfig()
+	_, confDir := makeFakeCNIConfig(t)
+	l.pluginConfDir = confDir
+	l.networkCount = 2
+	err := l.Load(WithIdempotentSetup, WithAllConf)
+	assert.NoError(t, err)
+
+	mockCNI := &MockCNI{}
+	l.networks[0].cni = mockCNI
+	l.networks[1].cni = mockCNI
+	ipv4, err := types.ParseCIDR("10.0.0.1/24")
+	assert.NoError(t, err)
+	rt0 := &cnilibrary.RuntimeConf{
+		ContainerID:    "container-id1",
+		NetNS:          "/proc/12345/ns/net",
+		IfName:         "eth0",
+		Args:           [][2]string(nil),
+		CapabilityArgs: map[string]interface{}{},
+	}
+	cached := &types100.Result{
+		CNIVersion: "1.0.0",
+		IPs: []*types100.IPConfig{
+			{
+				Address: *ipv4,
+			},
+		},
+	}
+	mockCNI.On("GetNetworkListCachedResult", l.networks[0].config, rt0).Return(cached, nil)
+	mockCNI.On("CheckNetworkList", l.networks[0].config, rt0).Return(nil)
+
+	ipv4, err = types.ParseCIDR("10.0.0.2/24")
+	assert.NoError(t, err)
+	rt1 := &cnilibrary.RuntimeConf{
+		ContainerID:    "container-id1",
+		NetNS:          "/proc/12345/ns/net",
+		IfName:         "eth1",
+		Args:           [][2]string(nil),
+		CapabilityArgs: map[string]interface{}{},
+	}
+	mockCNI.On("GetNetworkListCachedResult", l.networks[1].config, rt1).Return(nil, nil)
+	mockCNI.On("AddNetworkList", l.networks[1].config, rt1).Return(&types100.Result{
+		CNIVersion: "1.0.0",
+		Interfaces: []*types100.Interface{
+			{
+				Name: "eth1",
+			},
+		},
+		IPs: []*types100.IPConfig{
+			{
+				Interface: types100.Int(0),
+				Address:   *ipv4,
+			},
+		},
+	}, nil)
+
+	r, err := l.Setup(context.Background(), "container-id1", "/proc/12345/ns/net")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", r.Interfaces["eth0"].IPConfigs[0].IP.String())
+	assert.Equal(t, "10.0.0.2", r.Interfaces["eth1"].IPConfigs[0].IP.String())
+	mockCNI.AssertExpectations(t)
+	mockCNI.AssertNotCalled(t, "AddNetworkList", l.networks[0].config, rt0)
+}
+
+// TestLibCNISetupCancelled tests that the networks attached before the
+// context of Setup was cancelled are cleaned up
+func TestLibCNISetupCancelled(t *testing.T) {
+	t.Parallel()
+
+	l := defaultCNIConfig()
+	_, confDir := makeFakeCNIConfig(t)
+	l.pluginConfDir = confDir
+	l.networkCount = 2
+	err := l.Load(WithAllConf)
+	assert.NoError(t, err)
+
+	mockCNI := &MockCNI{}
+	l.networks[0].cni = mockCNI
+	l.networks[1].cni = mockCNI
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rt0 := &cnilibrary.RuntimeConf{
+		ContainerID:    "container-id1",
+		NetNS:          "/proc/12345/ns/net",
+		IfName:         "eth0",
+		Args:           [][2]string(nil),
+		CapabilityArgs: map[string]interface{}{},
+	}
+	mockCNI.On("AddNetworkList", l.networks[0].config, rt0).Return(&types100.Result{CNIVersion: "1.0.0"}, nil)
+	mockCNI.On("DelNetworkList", l.networks[0].config, rt0).Return(nil)
+	rt1 := &cnilibrary.RuntimeConf{
+		ContainerID:    "container-id1",
+		NetNS:          "/proc/12345/ns/net",
+		IfName:         "eth1",
+		Args:           [][2]string(nil),
+		CapabilityArgs: map[string]interface{}{},
+	}
+	mockCNI.On("AddNetworkList", l.networks[1].config, rt1).Run(func(mock.Arguments) {
+		cancel()
+	}).Return(&types100.Result{}, errors.New("signal: killed"))
+	mockCNI.On("DelNetworkList", l.networks[1].config, rt1).Return(nil)
+
+	_, err = l.SetupSerially(ctx, "container-id1", "/proc/12345/ns/net")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Contains(t, err.Error(), "cleaned up networks [plugin1 plugin2]")
+	mockCNI.AssertExpectations(t)
+}
+
+// TestLibCNISetupCancelledParallel tests that every network is cleaned
+// up when the context of a parallel Setup is cancelled during ADD
+func TestLibCNISetupCancelledParallel(t *testing.T) {
+	t.Parallel()
+
+	l := defaultCNIConfig()
+	_, confDir := makeFakeCNIConfig(t)
+	l.pluginConfDir = confDir
+	l.networkCount = 2
+	err := l.Load(WithAllConf)
+	assert.NoError(t, err)
+
+	mockCNI0, mockCNI1 := &MockCNI{}, &MockCNI{}
+	l.networks[0].cni = mockCNI0
+	l.networks[1].cni = mockCNI1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rt0 := &cnilibrary.RuntimeConf{
+		ContainerID:    "container-id1",
+		NetNS:          "/proc/12345/ns/net",
+		IfName:         "eth0",
+		Args:           [][2]string(nil),
+		CapabilityArgs: map[string]interface{}{},
+	}
+	// The first ADD is in flight until the context is cancelled.
+	mockCNI0.On("AddNetworkList", l.networks[0].config, rt0).Run(func(mock.Arguments) {
+		<-ctx.Done()
+	}).Return(&types100.Result{}, errors.New("signal: killed"))
+	mockCNI0.On("DelNetworkList", l.networks[0].config, rt0).Return(nil)
+	rt1 := &cnilibrary.RuntimeConf{
+		ContainerID:    "container-id1",
+		NetNS:          "/proc/12345/ns/net",
+		IfName:         "eth1",
+		Args:           [][2]string(nil),
+		CapabilityArgs: map[string]interface{}{},
+	}
+	mockCNI1.On("AddNetworkList", l.networks[1].config, rt1).Run(func(mock.Arguments) {
+		cancel()
+	}).Return(&types100.Result{}, errors.New("signal: killed"))
+	mockCNI1.On("DelNetworkList", l.networks[1].config, rt1).Return(nil)
+
+	_, err = l.Setup(ctx, "container-id1", "/proc/12345/ns/net")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Contains(t, err.Error(), "cleaned up networks [plugin1 plugin2]")
+	mockCNI0.AssertExpectations(t)
+	mockCNI1.AssertExpectations(t)
+}
+
+// TestLoadPluginConfDirs tests the precedence of layered config directories
+func TestLoadPluginConfDirs(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	distro, agent, override := path.Join(root, "distro"), path.Join(root, "agent"), path.Join(root, "override")
+	writeFakeConfFile(t, distro, "10-default.conf", `{"name": "distro-net", "type": "bridge"}`)
+	writeFakeConfFile(t, distro, "20-extra.conf", `{"name": "extra-net", "type": "macvlan"}`)
+	writeFakeConfFile(t, agent, "10-default.conf", `{"name": "agent-net", "type": "bridge"}`)
+	writeFakeConfFile(t, override, "20-extra.conf", `{"name": "override-net", "type": "ipvlan"}`)
+
+	l := defaultCNIConfig()
+	err := l.Load(WithPluginConfDirs([]string{distro, agent, override}), WithAllConf)
+	assert.NoError(t, err)
+
+	c := l.GetConfig()
+	assert.Equal(t, override, c.PluginConfDir)
+	assert.Equal(t, []string{distro, agent, override}, c.PluginConfDirs)
+	assert.Len(t, c.Networks, 2)
+	assert.Equal(t, "agent-net", c.Networks[0].Config.Name)
+	assert.Equal(t, agent, c.Networks[0].ConfDir)
+	assert.Equal(t, "eth0", c.Networks[0].IFName)
+	assert.Equal(t, "override-net", c.Networks[1].Config.Name)
+	assert.Equal(t, override, c.Networks[1].ConfDir)
+
+	// Network names must be unique across the layers.
+	writeFakeConfFile(t, override, "30-dup.conf", `{"name": "agent-net", "type": "ptp"}`)
+	err = l.Load(WithAllConf)
+	assert.ErrorIs(t, err, ErrLoad)
+	assert.Contains(t, err.Error(), "already defined")
+}
+
+// TestLoadConfFS tests loading network configs from a fs.FS and a reader
+func TestLoadConfFS(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"net.d/20-second.conflist": {Data: []byte(`{"cniVersion": "1.0.0", "name": "second", "plugins": [{"type": "bridge"}]}`)},
+		"net.d/10-first.conf":      {Data: []byte(`{"cniVersion": "1.0.0", "name": "first", "type": "ptp"}`)},
+		"net.d/README.md":          {Data: []byte(`not a config`)},
+		"net.d/subdir/30-x.conf":   {Data: []byte(`{"name": "x", "type": "ptp"}`)},
+	}
+
+	l := defaultCNIConfig()
+	err := l.Load(WithConfFS(fsys, "net.d"))
+	assert.NoError(t, err)
+	assert.Len(t, l.networks, 1)
+	assert.Equal(t, "first", l.networks[0].config.Name)
+
+	err = l.Load(WithAllConfFS(fsys, "net.d"), WithConfListReader(strings.NewReader(
+		`{"cniVersion": "1.0.0", "name": "third", "plugins": [{"type": "macvlan"}]}`)))
+	assert.NoError(t, err)
+	c := l.GetConfig()
+	assert.Len(t, c.Networks, 3)
+	assert.Equal(t, "first", c.Networks[0].Config.Name)
+	assert.Equal(t, "net.d/10-first.conf", c.Networks[0].ConfFile)
+	assert.Equal(t, "second", c.Networks[1].Config.Name)
+	assert.Equal(t, "eth1", c.Networks[1].IFName)
+	assert.Equal(t, "third", c.Networks[2].Config.Name)
+	assert.Equal(t, "eth2", c.Networks[2].IFName)
+
+	err = l.Load(WithConfFS(fsys, "empty"))
+	assert.ErrorIs(t, err, ErrLoad)
+}
+
+// TestLoadLenient tests that lenient loading skips invalid config files
+func TestLoadLenient(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"net.d/00-broken.conflist": {Data: []byte(`{"name": "broken", "plugins": [`)},
+		"net.d/10-notype.conf":     {Data: []byte(`{"name": "notype"}`)},
+		"net.d/20-empty.conflist":  {Data: []byte(`{"name": "empty", "plugins": []}`)},
+		"net.d/30-valid.conflist":  {Data: []byte(`{"cniVersion": "1.0.0", "name": "valid", "plugins": [{"type": "bridge"}]}`)},
+	}
+
+	l := defaultCNIConfig()
+	err := l.Load(WithConfFS(fsys, "net.d"))
+	assert.ErrorIs(t, err, ErrLoad)
+
+	err = l.Load(WithLenientLoad, WithConfFS(fsys, "net.d"))
+	assert.NoError(t, err)
+	c := l.GetConfig()
+	assert.Len(t, c.Networks, 1)
+	assert.Equal(t, "valid", c.Networks[0].Config.Name)
+	assert.Equal(t, "eth0", c.Networks[0].IFName)
+	assert.Len(t, c.Warnings, 3)
+	assert.Equal(t, "net.d/00-broken.conflist", c.Warnings[0].File)
+	assert.Equal(t, "net.d/10-notype.conf", c.Warnings[1].File)
+	assert.Contains(t, c.Warnings[1].Reason, "missing 'type'")
+	assert.Equal(t, "net.d/20-empty.conflist", c.Warnings[2].File)
+}
+
+// TestLoadDefaultNetwork tests the explicit selection of the default network
+func TestLoadDefaultNetwork(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"net.d/00-foo.conflist":     {Data: []byte(`{"cniVersion": "1.0.0", "name": "foo", "plugins": [{"type": "ptp"}]}`)},
+		"net.d/10-primary.conflist": {Data: []byte(`{"cniVersion": "1.0.0", "name": "primary", "plugins": [{"type": "bridge"}]}`)},
+		"net.d/20-marked.conflist":  {Data: []byte(`{"cniVersion": "1.0.0", "name": "marked", "io.containerd.cni.default-network": true, "plugins": [{"type": "bridge"}]}`)},
+		"net.d/30-extra.conflist":   {Data: []byte(`{"cniVersion": "1.0.0", "name": "extra", "plugins": [{"type": "macvlan"}]}`)},
+	}
+
+	l := defaultCNIConfig()
+	err := l.Load(WithDefaultNetwork("primary"), WithConfFS(fsys, "net.d"))
+	assert.NoError(t, err)
+	c := l.GetConfig()
+	assert.Len(t, c.Networks, 1)
+	assert.Equal(t, "primary", c.DefaultNetwork)
+	assert.Equal(t, "eth0", c.Networks[0].IFName)
+
+	err = l.Load(WithNetworkPriority([]string{"extra", "foo"}), WithAllConfFS(fsys, "net.d"))
+	assert.NoError(t, err)
+	c = l.GetConfig()
+	assert.Equal(t, "primary", c.DefaultNetwork)
+	var names []string
+	for _, n := range c.Networks {
+		names = append(names, n.Config.Name)
+	}
+	assert.Equal(t, []string{"primary", "extra", "foo", "marked"}, names)
+
+	err = l.Load(WithDefaultNetwork(""), WithDefaultNetworkMarker, WithConfFS(fsys, "net.d"))
+	assert.NoError(t, err)
+	assert.Equal(t, "marked", l.GetConfig().DefaultNetwork)
+
+	err = l.Load(WithDefaultNetwork("missing"), WithConfFS(fsys, "net.d"))
+	assert.ErrorIs(t, err, ErrLoad)
+}
+
+// TestLoadFilters tests the include and exclude patterns of directory loading
+func TestLoadFilters(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"net.d/00-primary.conflist":  {Data: []byte(`{"cniVersion": "1.0.0", "name": "primary", "plugins": [{"type": "bridge"}]}`)},
+		"net.d/multus-a.conflist":    {Data: []byte(`{"cniVersion": "1.0.0", "name": "multus-a", "plugins": [{"type": "macvlan"}]}`)},
+		"net.d/multus-b.conflist":    {Data: []byte(`{"cniVersion": "1.0.0", "name": "multus-b", "plugins": [{"type": "ipvlan"}]}`)},
+		"net.d/multus-test.conflist": {Data: []byte(`{"cniVersion": "1.0.0", "name": "test-net", "plugins": [{"type": "ipvlan"}]}`)},
+	}
+
+	l := defaultCNIConfig()
+	// The filtered files do not count towards the max config number.
+	err := l.Load(WithConfFileFilter([]string{"multus-*"}, nil), WithNetworkNameFilter(nil, []string{"*-a"}), WithConfFS(fsys, "net.d"))
+	assert.NoError(t, err)
+	assert.Len(t, l.networks, 1)
+	assert.Equal(t, "multus-b", l.networks[0].config.Name)
+	assert.Equal(t, "eth0", l.networks[0].ifName)
+
+	err = l.Load(WithNetworkNameFilter([]string{"multus-*"}, nil), WithAllConfFS(fsys, "net.d"))
+	assert.NoError(t, err)
+	assert.Len(t, l.networks, 2)
+	assert.Equal(t, "multus-a", l.networks[0].config.Name)
+	assert.Equal(t, "multus-b", l.networks[1].config.Name)
+
+	err = l.Load(WithConfFileFilter([]string{"["}, nil))
+	assert.ErrorIs(t, err, ErrLoad)
+}
+
+// TestLoadDuplicates tests the detection of duplicate networks on load
+func TestLoadDuplicates(t *testing.T) {
+	t.Parallel()
+
+	net1 := []byte(`{"cniVersion": "1.0.0", "name": "net1", "type": "bridge"}`)
+	net2 := []byte(`{"cniVersion": "1.0.0", "name": "net2", "type": "bridge"}`)
+	net1List := []byte(`{"cniVersion": "1.0.0", "name": "net1", "plugins": [{"type": "bridge"}]}`)
+
+	l := defaultCNIConfig()
+	err := l.Load(WithConfListBytes(net1List), WithConfListBytes(net1List))
+	assert.ErrorIs(t, err, ErrLoad)
+	assert.Contains(t, err.Error(), "network net1 is already defined")
+
+	err = l.Load(WithConf(net1), WithConf(net2))
+	assert.ErrorIs(t, err, ErrLoad)
+	assert.Contains(t, err.Error(), "interface name eth0 of network net2 is already used by network net1")
+
+	err = l.Load(WithDeduplicateNetworks, WithConf(net1), WithConf(net2), WithConfListBytes(net1List))
+	assert.NoError(t, err)
+	c := l.GetConfig()
+	assert.Len(t, c.Networks, 1)
+	assert.Equal(t, "net1", c.Networks[0].Config.Name)
+	assert.Len(t, c.Warnings, 2)
+
+	err = l.Load(WithInterfacePrefix("averylonginterface"), WithConf(net1))
+	assert.ErrorIs(t, err, ErrLoad)
+	assert.Contains(t, err.Error(), "longer than 15 bytes")
+}
+
+// TestLoadIfNameFunc tests custom interface naming on every load path
+func TestLoadIfNameFunc(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"net.d/10-a.conflist": {Data: []byte(`{"cniVersion": "1.0.0", "name": "a", "plugins": [{"type": "bridge"}]}`)},
+		"net.d/20-b.conflist": {Data: []byte(`{"cniVersion": "1.0.0", "name": "b", "plugins": [{"type": "bridge"}]}`)},
+	}
+	ifNameFunc := func(index int, conf *cnilibrary.NetworkConfigList) string {
+		return fmt.Sprintf("net-%s", conf.Name)
+	}
+
+	l := defaultCNIConfig()
+	err := l.Load(
+		WithIfNameFunc(ifNameFunc),
+		WithPluginDir([]string{t.TempDir()}),
+		WithLoNetwork,
+		WithConf([]byte(`{"cniVersion": "1.0.0", "name": "c", "type": "bridge"}`)),
+		WithConfListBytes([]byte(`{"cniVersion": "1.0.0", "name": "d", "plugins": [{"type": "bridge"}]}`)),
+		WithAllConfFS(fsys, "net.d"),
+	)
+	assert.NoError(t, err)
+	var ifNames []string
+	for _, n := range l.networks {
+		ifNames = append(ifNames, n.ifName)
+	}
+	assert.Equal(t, []string{"lo", "net-c", "net-d", "net-a", "net-b"}, ifNames)
+}
+
+// TestLibCNISetupIfNameFunc tests that the default interface of the
+// result follows custom interface naming
+func TestLibCNISetupIfNameFunc(t *testing.T) {
+	t.Parallel()
+
+	l := defaultCNIConfig()
+	err := l.Load(
+		WithIfNameFunc(func(index int, conf *cnilibrary.NetworkConfigList) string {
+			return fmt.Sprintf("net-%s", conf.Name)
+		}),
+		WithConf([]byte(`{"cniVersion": "1.0.0", "name": "a", "type": "bridge"}`)),
+		WithConf([]byte(`{"cniVersion": "1.0.0", "name": "b", "type": "bridge"}`)),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", l.GetConfig().DefaultNetwork)
+
+	mockCNI := &MockCNI{}
+	l.networks[0].cni = mockCNI
+	l.networks[1].cni = mockCNI
+	ipv4, err := types.ParseCIDR("10.0.0.1/24")
+	assert.NoError(t, err)
+	mockCNI.On("AddNetworkList", l.networks[0].config, mock.Anything).Return(&types100.Result{
+		CNIVersion: "1.0.0",
+		IPs:        []*types100.IPConfig{{Address: *ipv4}},
+	}, nil)
+	mockCNI.On("AddNetworkList", l.networks[1].config, mock.Anything).Return(&types100.Result{
+		CNIVersion: "1.0.0",
+		Interfaces: []*types100.Interface{{Name: "net-b"}},
+	}, nil)
+
+	r, err := l.Setup(context.Background(), "container-id1", "/proc/12345/ns/net")
+	assert.NoError(t, err)
+	assert.NotContains(t, r.Interfaces, "eth0")
+	if assert.Contains(t, r.Interfaces, "net-a") && assert.Len(t, r.Interfaces["net-a"].IPConfigs, 1) {
+		assert.Equal(t, "10.0.0.1", r.Interfaces["net-a"].IPConfigs[0].IP.String())
+	}
+	assert.Contains(t, r.Interfaces, "net-b")
+	mockCNI.AssertExpectations(t)
+}
+
+// TestLoadLoNetwork tests loading the loopback network
+func TestLoadLoNetwork(t *testing.T) {
+	t.Parallel()
+
+	mockCNI := &MockCNI{}
+	mockCNI.On("GetVersionInfo", "loopback").Return(version.PluginSupports("0.3.1", "0.4.0", "1.0.0", "1.1.0", "99.0.0"), nil).Once()
+	mockCNI.On("GetVersionInfo", "loopback").Return(version.PluginSupports("0.3.1"), errors.New("loopback not found")).Once()
+
+	l := defaultCNIConfig()
+	l.cniConfig = mockCNI
+	assert.NoError(t, l.Load(WithLoNetwork))
+	assert.Equal(t, "1.1.0", l.networks[0].config.CNIVersion)
+	assert.Equal(t, "lo", l.networks[0].ifName)
+
+	assert.NoError(t, l.Load(WithLoNetwork))
+	assert.Equal(t, "0.3.1", l.networks[0].config.CNIVersion)
+	mockCNI.AssertExpectations(t)
+
+	// The version is cached by loopback plugin binary.
+	pluginDir := t.TempDir()
+	loopback := filepath.Join(pluginDir, "loopback")
+	assert.NoError(t, os.WriteFile(loopback, []byte("loopback"), 0o755))
+	exec := &fakeExec{output: []byte(`{"cniVersion": "1.0.0", "supportedVersions": ["0.3.1", "1.0.0"]}`)}
+	plugins := NetworkPlugins{Dirs: []string{pluginDir}, Exec: exec}
+	assert.NoError(t, l.Load(WithNetworkPlugins(plugins, WithLoNetwork)))
+	assert.NoError(t, l.Load(WithNetworkPlugins(plugins, WithLoNetwork)))
+	assert.Equal(t, "1.0.0", l.networks[0].config.CNIVersion)
+	assert.Equal(t, []string{loopback}, exec.calls)
+	// A new binary is asked again.
+	assert.NoError(t, os.WriteFile(loopback, []byte("new loopback"), 0o755))
+	assert.NoError(t, l.Load(WithNetworkPlugins(plugins, WithLoNetwork)))
+	assert.Equal(t, []string{loopback, loopback}, exec.calls)
+
+	err := l.Load(WithLoNetworkConfig([]byte(`{
+		"cniVersion": "1.1.0",
+		"name": "custom-loopback",
+		"plugins": [{"type": "my-loopback"}, {"type": "tuning", "sysctl": {"net.ipv6.conf.lo.disable_ipv6": "0"}}]
+	}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, "custom-loopback", l.networks[0].config.Name)
+	assert.Equal(t, "my-loopback", l.networks[0].config.Plugins[0].Network.Type)
+	assert.Equal(t, "lo", l.networks[0].ifName)
+
+	err = l.Load(WithLoNetworkConfig([]byte(`{"cniVersion": "1.1.0", "name": "lo", "plugins": []}`)))
+	assert.ErrorIs(t, err, ErrLoad)
+}
+
+// TestLoadCNIVersionOverride tests overriding the CNI version of networks on load
+func TestLoadCNIVersionOverride(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"net.d/10-old.conflist": {Data: []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "old",
+			"plugins": [{"type": "bridge", "ipam": {"type": "host-local", "subnet": "10.88.0.0/16"}}]
+		}`)},
+		"net.d/20-none.conf":          {Data: []byte(`{"name": "none", "type": "ptp"}`)},
+		"net.d/30-newer.conflist":     {Data: []byte(`{"cniVersion": "1.1.0", "name": "newer", "plugins": [{"type": "bridge"}]}`)},
+		"net.d/40-legacy.conflist":    {Data: []byte(`{"cniVersion": "0.3.1", "name": "legacy", "plugins": [{"type": "legacy"}]}`)},
+		"net.d/50-untouched.conflist": {Data: []byte(`{"cniVersion": "0.4.0", "name": "untouched", "plugins": [{"type": "legacy"}]}`)},
+	}
+
+	mockCNI := &MockCNI{}
+	current := version.PluginSupports("0.3.1", "0.4.0", "1.0.0", "1.1.0")
+	for _, pluginType := range []string{"bridge", "host-local", "ptp"} {
+		mockCNI.On("GetVersionInfo", pluginType).Return(current, nil).Once()
+	}
+	mockCNI.On("GetVersionInfo", "legacy").Return(version.PluginSupports("0.3.1", "0.4.0"), nil).Once()
+
+	l := defaultCNIConfig()
+	l.cniConfig = mockCNI
+	err := l.Load(WithCNIVersionOverride(
+		CNIVersionOverride{Network: "newer", Version: "1.0.0", Force: true},
+		CNIVersionOverride{Network: "untouched", Version: "0.3.1"},
+		CNIVersionOverride{Version: "1.1.0"},
+	), WithAllConfFS(fsys, "net.d"))
+	assert.NoError(t, err)
+	mockCNI.AssertExpectations(t)
+
+	versions := make(map[string]string)
+	for _, n := range l.networks {
+		versions[n.config.Name] = n.config.CNIVersion
+	}
+	assert.Equal(t, map[string]string{
+		"old":       "1.1.0",
+		"none":      "1.1.0",
+		"newer":     "1.0.0",
+		"untouched": "0.4.0",
+	}, versions)
+
+	c := l.GetConfig()
+	assert.Equal(t, "0.3.1", c.Networks[0].Original.CNIVersion)
+	assert.Equal(t, "1.1.0", c.Networks[0].Config.CNIVersion)
+	if assert.Len(t, c.Warnings, 1) {
+		assert.Equal(t, "40-legacy.conflist", path.Base(c.Warnings[0].File))
+		assert.Contains(t, c.Warnings[0].Reason, "plugin legacy does not support it")
+	}
+
+	err = l.Load(WithCNIVersionOverride(CNIVersionOverride{Version: "99.0.0"}))
+	assert.ErrorIs(t, err, ErrLoad)
+
+	// The default network is never skipped.
+	mockCNI.On("GetVersionInfo", "legacy").Return(version.PluginSupports("0.3.1", "0.4.0"), nil).Once()
+	err = l.Load(WithCNIVersionOverride(CNIVersionOverride{Version: "1.1.0"}), WithAllConfFS(fstest.MapFS{
+		"net.d/10-legacy.conflist": fsys["net.d/40-legacy.conflist"],
+		"net.d/20-newer.conflist":  fsys["net.d/30-newer.conflist"],
+	}, "net.d"))
+	assert.ErrorIs(t, err, ErrLoad)
+	assert.Contains(t, err.Error(), "default network legacy")
+	mockCNI.AssertExpectations(t)
+}
+
+// TestVendorPluginDir tests looking up plugins in vendor plugin directories
+func TestVendorPluginDir(t *testing.T) {
+	t.Parallel()
+
+	root, otherDir := t.TempDir(), t.TempDir()
+	vendorDir := filepath.Join(root, "opt", "acme", "bin")
+	writeFakeConfFile(t, vendorDir, "bridge", "")
+	writeFakeConfFile(t, vendorDir, "portmap", "")
+	writeFakeConfFile(t, otherDir, "portmap", "")
+
+	c, err := New(
+		WithPluginDir([]string{otherDir, DefaultCNIDir}),
+		WithVendorPluginDir(root, "acme"),
+		WithVendorPluginDir(root, "acme"),
+		WithConfListBytes([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "net",
+			"plugins": [{"type": "bridge", "ipam": {"type": "acme-ipam"}}, {"type": "portmap"}]
+		}`)),
+	)
+	assert.NoError(t, err)
+
+	r := c.GetConfig()
+	assert.Equal(t, []string{otherDir, vendorDir, DefaultCNIDir}, r.PluginDirs)
+	assert.Equal(t, []*PluginResolution{
+		{Type: "acme-ipam", Dirs: r.PluginDirs},
+		{Type: "bridge", Path: filepath.Join(vendorDir, "bridge"), Dir: vendorDir, Dirs: r.PluginDirs},
+		{Type: "portmap", Path: filepath.Join(otherDir, "portmap"), Dir: otherDir, Dirs: r.PluginDirs},
+	}, r.Plugins)
+
+	// The plugins are resolved when the networks are loaded.
+	writeFakeConfFile(t, vendorDir, "acme-ipam", "")
+	assert.Empty(t, c.GetConfig().Plugins[0].Path)
+	assert.NoError(t, c.Load(WithConfListBytes([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "net",
+		"plugins": [{"type": "bridge", "ipam": {"type": "acme-ipam"}}]
+	}`))))
+	assert.Equal(t, filepath.Join(vendorDir, "acme-ipam"), c.GetConfig().Plugins[0].Path)
+
+	_, err = New(WithVendorPluginDir(root, ""))
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
+
+// TestNetworkPlugins tests loading networks with their own plugin directories and executor
+func TestNetworkPlugins(t *testing.T) {
+	t.Parallel()
+
+	globalDir, vendorDir := t.TempDir(), t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(vendorDir, "bridge"), []byte("vendor bridge"), 0o755))
+	exec := &fakeExec{output: []byte(`{"cniVersion": "1.0.0", "supportedVersions": ["1.0.0"]}`)}
+
+	c, err := New(
+		WithPluginDir([]string{globalDir}),
+		WithConfListBytes([]byte(`{"cniVersion": "1.0.0", "name": "global", "plugins": [{"type": "bridge"}]}`)),
+		WithNetworkPlugins(NetworkPlugins{Dirs: []string{vendorDir}, Exec: exec},
+			WithConfListBytes([]byte(`{"cniVersion": "1.0.0", "name": "vendor", "plugins": [{"type": "bridge"}]}`)),
+		),
+	)
+	assert.NoError(t, err)
+
+	r := c.GetConfig()
+	assert.Equal(t, []string{globalDir}, r.PluginDirs)
+	assert.Equal(t, []string{globalDir}, r.Networks[0].PluginDirs)
+	assert.Equal(t, []string{vendorDir}, r.Networks[1].PluginDirs)
+	assert.Equal(t, []*PluginResolution{
+		{Type: "bridge", Dirs: []string{globalDir}},
+		{Type: "bridge", Path: filepath.Join(vendorDir, "bridge"), Dir: vendorDir, Dirs: []string{vendorDir}},
+	}, r.Plugins)
+
+	plugins, err := c.(PluginInspector).PluginInventory(context.Background())
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Len(t, plugins, 2)
+	assert.Equal(t, []string{"1.0.0"}, plugins[1].Versions)
+	assert.Equal(t, []string{filepath.Join(vendorDir, "bridge")}, exec.calls)
+}
+
+// TestNetworkPluginsCNIVersionOverride tests that the plugins are asked
+// for their versions through the executor of every network
+func TestNetworkPluginsCNIVersionOverride(t *testing.T) {
+	t.Parallel()
+
+	newDir, oldDir := t.TempDir(), t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(newDir, "bridge"), []byte("new bridge"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(oldDir, "bridge"), []byte("old bridge"), 0o755))
+	newExec := &fakeExec{output: []byte(`{"cniVersion": "1.1.0", "supportedVersions": ["1.0.0", "1.1.0"]}`)}
+	oldExec := &fakeExec{output: []byte(`{"cniVersion": "1.0.0", "supportedVersions": ["1.0.0"]}`)}
+
+	l := defaultCNIConfig()
+	err := l.Load(
+		WithCNIVersionOverride(CNIVersionOverride{Version: "1.1.0"}),
+		WithNetworkPlugins(NetworkPlugins{Dirs: []string{newDir}, Exec: newExec},
+			WithConfListBytes([]byte(`{"cniVersion": "1.0.0", "name": "new", "plugins": [{"type": "bridge"}]}`)),
+		),
+		WithNetworkPlugins(NetworkPlugins{Dirs: []string{oldDir}, Exec: oldExec},
+			WithConfListBytes([]byte(`{"cniVersion": "1.0.0", "name": "old", "plugins": [{"type": "bridge"}]}`)),
+		),
+	)
+	assert.NoError(t, err)
+	assert.Len(t, l.networks, 1)
+	assert.Equal(t, "1.1.0", l.networks[0].config.CNIVersion)
+	assert.Equal(t, []string{filepath.Join(newDir, "bridge")}, newExec.calls)
+	assert.Equal(t, []string{filepath.Join(oldDir, "bridge")}, oldExec.calls)
+	if assert.Len(t, l.warnings, 1) {
+		assert.Contains(t, l.warnings[0].Reason, "network old can not be set to CNI version 1.1.0")
+	}
+}
+
+// TestLoadConfPatches tests patching the network config lists on load
+func TestLoadConfPatches(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"net.d/10-net.conflist": {Data: []byte(`{
+			"cniVersion": "1.0.0",
+			"name": "net",
+			"plugins": [
+				{"type": "bridge", "bridge": "cni0", "ipam": {"type": "host-local", "subnet": "10.88.0.0/16"}},
+				{"type": "portmap", "capabilities": {"portMappings": true}}
+			]
+		}`)},
+		"net.d/20-other.conflist": {Data: []byte(`{"cniVersion": "1.0.0", "name": "other", "plugins": [{"type": "bridge"}]}`)},
+	}
+
+	l := defaultCNIConfig()
+	err := l.Load(WithConfPatches(
+		ConfPatch{
+			Network:    "net",
+			PluginType: "bridge",
+			MergePatch: []byte(`{"mtu": 1450, "bridge": "br-node", "ipam": {"subnet": "10.1.2.0/24"}}`),
+		},
+		ConfPatch{
+			Network:   "net",
+			JSONPatch: []byte(`[{"op": "remove", "path": "/plugins/1"}, {"op": "add", "path": "/disableCheck", "value": true}]`),
+		},
+	), WithAllConfFS(fsys, "net.d"))
+	assert.NoError(t, err)
+
+	network := l.networks[0].config
+	assert.True(t, network.DisableCheck)
+	assert.Len(t, network.Plugins, 1)
+	var bridge map[string]interface{}
+	assert.NoError(t, json.Unmarshal(network.Plugins[0].Bytes, &bridge))
+	assert.Equal(t, float64(1450), bridge["mtu"])
+	assert.Equal(t, "br-node", bridge["bridge"])
+	assert.Equal(t, map[string]interface{}{"type": "host-local", "subnet": "10.1.2.0/24"}, bridge["ipam"])
+
+	c := l.GetConfig()
+	assert.Len(t, c.Networks[0].Original.Plugins, 2)
+	assert.Contains(t, c.Networks[0].Original.Source, "cni0")
+	assert.Contains(t, c.Networks[0].Config.Source, "br-node")
+	assert.Equal(t, c.Networks[1].Original.Source, c.Networks[1].Config.Source)
+
+	err = l.Load(WithConfPatches(ConfPatch{
+		JSONPatch: []byte(`[{"op": "test", "path": "/name", "value": "unexpected"}]`),
+	}), WithAllConfFS(fsys, "net.d"))
+	assert.ErrorIs(t, err, ErrLoad)
+}
+
+// TestLoadPluginInjection tests injecting plugins in the network config lists on load
+func TestLoadPluginInjection(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"net.d/10-net.conflist":   {Data: []byte(`{"cniVersion": "1.0.0", "name": "net", "plugins": [{"type": "bridge"}, {"type": "portmap"}]}`)},
+		"net.d/20-other.conflist": {Data: []byte(`{"cniVersion": "1.0.0", "name": "other", "plugins": [{"type": "ptp"}, {"type": "bandwidth"}]}`)},
+	}
+
+	pluginTypes := func(n *Network) []string {
+		var types []string
+		for _, plugin := range n.config.Plugins {
+			types = append(types, plugin.Network.Type)
+		}
+		return types
+	}
+
+	l := defaultCNIConfig()
+	err := l.Load(WithPluginDir([]string{t.TempDir()}), WithLoNetwork, WithPluginInjection(
+		PluginInjection{
+			Plugins: [][]byte{
+				[]byte(`{"type": "bandwidth", "capabilities": {"bandwidth": true}}`),
+				[]byte(`{"type": "tuning"}`),
+			},
+		},
+		PluginInjection{
+			Selector: func(conf *cnilibrary.NetworkConfigList) bool { return conf.Name == "net" },
+			Prepend:  true,
+			Plugins:  [][]byte{[]byte(`{"type": "firewall"}`)},
+		},
+	), WithAllConfFS(fsys, "net.d"))
+	assert.NoError(t, err)
+	assert.Len(t, l.networks, 3)
+
+	assert.Equal(t, []string{"loopback"}, pluginTypes(l.networks[0]))
+	assert.Equal(t, []string{"firewall", "bridge", "portmap", "bandwidth", "tuning"}, pluginTypes(l.networks[1]))
+	assert.Equal(t, []string{"ptp", "bandwidth", "tuning"}, pluginTypes(l.networks[2]))
+	assert.Contains(t, string(l.networks[1].config.Bytes), `"firewall"`)
+	assert.Equal(t, `{"capabilities":{"bandwidth":true},"type":"bandwidth"}`, string(l.networks[1].config.Plugins[3].Bytes))
+
+	c := l.GetConfig()
+	assert.Len(t, c.Networks[1].Original.Plugins, 2)
+	assert.Len(t, c.Networks[1].Config.Plugins, 5)
+
+	err = l.Load(WithPluginInjection(PluginInjection{Plugins: [][]byte{[]byte(`{"name": "no-type"}`)}}))
+	assert.ErrorIs(t, err, ErrLoad)
+	assert.ErrorContains(t, err, "invalid plugin config")
+}
+
+// TestLoadConfVariables tests the expansion of variables in network configs
+func TestLoadConfVariables(t *testing.T) {
+	t.Setenv("CNI_TEST_NODE_IP", "192.168.1.10")
+
+	fsys := fstest.MapFS{
+		"net.d/10-net.conflist": {Data: []byte(`{
+			"cniVersion": "1.0.0",
+			"name": "net",
+			"plugins": [
+				{"type": "bridge", "mtu": ${MTU}, "ipam": {"subnet": "${POD_CIDR}"}, "nodeIP": "${CNI_TEST_NODE_IP}", "literal": "$${POD_CIDR}"}
+			]
+		}`)},
+	}
+
+	l := defaultCNIConfig()
+	vars := map[string]string{"POD_CIDR": "10.1.2.0/24", "MTU": "1450"}
+	err := l.Load(WithConfVariables(vars), WithConfEnvVariables, WithConfFS(fsys, "net.d"),
+		WithConfIndex([]byte(`{"cniVersion": "1.0.0", "name": "ptp-${MTU}", "type": "ptp"}`), 1))
+	assert.NoError(t, err)
+	var bridge map[string]interface{}
+	assert.NoError(t, json.Unmarshal(l.networks[0].config.Plugins[0].Bytes, &bridge))
+	assert.Equal(t, float64(1450), bridge["mtu"])
+	assert.Equal(t, map[string]interface{}{"subnet": "10.1.2.0/24"}, bridge["ipam"])
+	assert.Equal(t, "192.168.1.10", bridge["nodeIP"])
+	assert.Equal(t, "${POD_CIDR}", bridge["literal"])
+	assert.Equal(t, "ptp-1450", l.networks[1].config.Name)
+
+	delete(vars, "MTU")
+	err = l.Load(WithConfFS(fsys, "net.d"))
+	assert.ErrorIs(t, err, ErrLoad)
+	assert.Contains(t, err.Error(), `net.d/10-net.conflist at line 5: undefined variable "MTU"`)
+
+	// The values are escaped, so they can not break out of a string.
+	t.Setenv("CNI_TEST_NODE_IP", `x", "type": "evil`)
+	vars["MTU"] = "1450"
+	vars["POD_CIDR"] = `C:\cni`
+	err = l.Load(WithConfFS(fsys, "net.d"))
+	assert.NoError(t, err)
+	bridge = nil
+	assert.NoError(t, json.Unmarshal(l.networks[0].config.Plugins[0].Bytes, &bridge))
+	assert.Equal(t, "bridge", bridge["type"])
+	assert.Equal(t, `x", "type": "evil`, bridge["nodeIP"])
+	assert.Equal(t, map[string]interface{}{"subnet": `C:\cni`}, bridge["ipam"])
+
+	// Nor can a value used as a number add members.
+	vars["MTU"] = `1450, "type": "evil"`
+	err = l.Load(WithConfFS(fsys, "net.d"))
+	assert.ErrorIs(t, err, ErrLoad)
+}
+
 type MockCNI struct {
 	mock.Mock
 }
@@ -471,6 +1270,9 @@ func (m *MockCNI) GetNetworkListCachedConfig(net *cnilibrary.NetworkConfigList,
 
 func (m *MockCNI) GetNetworkListCachedResult(net *cnilibrary.NetworkConfigList, rt *cnilibrary.RuntimeConf) (types.Result, error) {
 	args := m.Called(net, rt)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
 	return args.Get(0).(types.Result), args.Error(1)
 }
 
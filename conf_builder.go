@@ -0,0 +1,496 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	cnilibrary "github.com/containernetworking/cni/libcni"
+)
+
+// DefaultConfListCNIVersion is the CNI version of the network config
+// lists built by ConfListBuilder, unless set otherwise.
+const DefaultConfListCNIVersion = "1.0.0"
+
+// Plugin is a plugin config added to a ConfListBuilder.
+type Plugin interface {
+	// Type returns the plugin type, i.e. the name of its binary.
+	Type() string
+	// Validate returns an error if a required field is missing or a
+	// field is invalid.
+	Validate() error
+}
+
+// IPAM is an IPAM plugin config used by the interface plugins.
+type IPAM interface {
+	Plugin
+}
+
+// capabilitiesPlugin is implemented by the plugins supporting runtime
+// config through capabilities.
+type capabilitiesPlugin interface {
+	Capabilities() map[string]bool
+}
+
+// ConfListBuilder builds network config lists from typed plugin configs.
+// The bytes it builds can be loaded with WithConfListBytes.
+type ConfListBuilder struct {
+	name         string
+	cniVersion   string
+	disableCheck bool
+	disableGC    bool
+	plugins      []Plugin
+}
+
+// NewConfListBuilder returns a builder for the network config list name.
+func NewConfListBuilder(name string) *ConfListBuilder {
+	return &ConfListBuilder{
+		name:       name,
+		cniVersion: DefaultConfListCNIVersion,
+	}
+}
+
+// CNIVersion sets the CNI version of the network config list.
+func (b *ConfListBuilder) CNIVersion(version string) *ConfListBuilder {
+	b.cniVersion = version
+	return b
+}
+
+// DisableCheck disables CHECK for the network config list.
+func (b *ConfListBuilder) DisableCheck() *ConfListBuilder {
+	b.disableCheck = true
+	return b
+}
+
+// DisableGC disables GC for the network config list.
+func (b *ConfListBuilder) DisableGC() *ConfListBuilder {
+	b.disableGC = true
+	return b
+}
+
+// Plugins appends plugins to the plugin chain.
+func (b *ConfListBuilder) Plugins(plugins ...Plugin) *ConfListBuilder {
+	b.plugins = append(b.plugins, plugins...)
+	return b
+}
+
+// Bytes validates the network config list and returns its JSON.
+func (b *ConfListBuilder) Bytes() ([]byte, error) {
+	if b.name == "" {
+		return nil, fmt.Errorf("network name is required: %w", ErrInvalidConfig)
+	}
+	if b.cniVersion == "" {
+		return nil, fmt.Errorf("cni version of network %s is required: %w", b.name, ErrInvalidConfig)
+	}
+	if len(b.plugins) == 0 {
+		return nil, fmt.Errorf("network %s has no plugins: %w", b.name, ErrInvalidConfig)
+	}
+	plugins := make([]map[string]interface{}, 0, len(b.plugins))
+	for i, p := range b.plugins {
+		conf, err := pluginConf(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid plugin %d of network %s: %v: %w", i, b.name, err, ErrInvalidConfig)
+		}
+		plugins = append(plugins, conf)
+	}
+	bytes, err := json.Marshal(struct {
+		CNIVersion   string                   `json:"cniVersion"`
+		Name         string                   `json:"name"`
+		DisableCheck bool                     `json:"disableCheck,omitempty"`
+		DisableGC    bool                     `json:"disableGC,omitempty"`
+		Plugins      []map[string]interface{} `json:"plugins"`
+	}{
+		CNIVersion:   b.cniVersion,
+		Name:         b.name,
+		DisableCheck: b.disableCheck,
+		DisableGC:    b.disableGC,
+		Plugins:      plugins,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Make sure libcni accepts what was built.
+	if _, err := cnilibrary.ConfListFromBytes(bytes); err != nil {
+		return nil, fmt.Errorf("invalid network %s: %v: %w", b.name, err, ErrInvalidConfig)
+	}
+	return bytes, nil
+}
+
+// pluginConf validates the plugin and returns its raw JSON, with its
+// type and capabilities set.
+func pluginConf(p Plugin) (map[string]interface{}, error) {
+	if p == nil {
+		return nil, fmt.Errorf("plugin is nil")
+	}
+	if p.Type() == "" {
+		return nil, fmt.Errorf("plugin type is required")
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", p.Type(), err)
+	}
+	conf, err := rawPlugin(p)
+	if err != nil {
+		return nil, err
+	}
+	if cp, ok := p.(capabilitiesPlugin); ok {
+		conf["capabilities"] = cp.Capabilities()
+	}
+	return conf, nil
+}
+
+// rawPlugin returns the raw JSON of the plugin with its type set.
+func rawPlugin(p Plugin) (map[string]interface{}, error) {
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	conf := make(map[string]interface{})
+	if err := decodeJSON(bytes, &conf); err != nil {
+		return nil, err
+	}
+	conf["type"] = p.Type()
+	return conf, nil
+}
+
+// ipamConf validates an IPAM config, which is required if required is set.
+func ipamConf(ipam IPAM, required bool) error {
+	if ipam == nil {
+		if required {
+			return fmt.Errorf("ipam is required")
+		}
+		return nil
+	}
+	if ipam.Type() == "" {
+		return fmt.Errorf("ipam type is required")
+	}
+	if err := ipam.Validate(); err != nil {
+		return fmt.Errorf("ipam %s: %w", ipam.Type(), err)
+	}
+	return nil
+}
+
+// BridgePlugin is the config of the bridge plugin.
+type BridgePlugin struct {
+	Bridge           string `json:"bridge,omitempty"`
+	IsGateway        bool   `json:"isGateway,omitempty"`
+	IsDefaultGateway bool   `json:"isDefaultGateway,omitempty"`
+	ForceAddress     bool   `json:"forceAddress,omitempty"`
+	IPMasq           bool   `json:"ipMasq,omitempty"`
+	HairpinMode      bool   `json:"hairpinMode,omitempty"`
+	PromiscMode      bool   `json:"promiscMode,omitempty"`
+	MTU              int    `json:"mtu,omitempty"`
+	VLAN             int    `json:"vlan,omitempty"`
+	// IPAM is optional, a bridge without IPAM is a layer 2 network.
+	IPAM IPAM `json:"-"`
+}
+
+func (p *BridgePlugin) Type() string { return "bridge" }
+
+func (p *BridgePlugin) Validate() error {
+	if err := validateMTU(p.MTU); err != nil {
+		return err
+	}
+	if p.VLAN < 0 || p.VLAN > 4094 {
+		return fmt.Errorf("invalid vlan %d", p.VLAN)
+	}
+	return ipamConf(p.IPAM, false)
+}
+
+func (p *BridgePlugin) MarshalJSON() ([]byte, error) {
+	type plain BridgePlugin
+	return marshalWithIPAM((*plain)(p), p.IPAM)
+}
+
+// PTPPlugin is the config of the ptp plugin.
+type PTPPlugin struct {
+	IPMasq bool `json:"ipMasq,omitempty"`
+	MTU    int  `json:"mtu,omitempty"`
+	IPAM   IPAM `json:"-"`
+}
+
+func (p *PTPPlugin) Type() string { return "ptp" }
+
+func (p *PTPPlugin) Validate() error {
+	if err := validateMTU(p.MTU); err != nil {
+		return err
+	}
+	return ipamConf(p.IPAM, true)
+}
+
+func (p *PTPPlugin) MarshalJSON() ([]byte, error) {
+	type plain PTPPlugin
+	return marshalWithIPAM((*plain)(p), p.IPAM)
+}
+
+// MacvlanPlugin is the config of the macvlan plugin.
+type MacvlanPlugin struct {
+	// Master defaults to the interface of the default route.
+	Master string `json:"master,omitempty"`
+	// Mode is one of bridge, private, vepa and passthru.
+	Mode string `json:"mode,omitempty"`
+	MTU  int    `json:"mtu,omitempty"`
+	// IPAM is optional, an interface without IPAM has no addresses.
+	IPAM IPAM `json:"-"`
+}
+
+func (p *MacvlanPlugin) Type() string { return "macvlan" }
+
+func (p *MacvlanPlugin) Validate() error {
+	switch p.Mode {
+	case "", "bridge", "private", "vepa", "passthru":
+	default:
+		return fmt.Errorf("invalid mode %q", p.Mode)
+	}
+	if err := validateMTU(p.MTU); err != nil {
+		return err
+	}
+	return ipamConf(p.IPAM, false)
+}
+
+func (p *MacvlanPlugin) MarshalJSON() ([]byte, error) {
+	type plain MacvlanPlugin
+	return marshalWithIPAM((*plain)(p), p.IPAM)
+}
+
+// IPVlanPlugin is the config of the ipvlan plugin.
+type IPVlanPlugin struct {
+	// Master defaults to the interface of the default route.
+	Master string `json:"master,omitempty"`
+	// Mode is one of l2, l3 and l3s.
+	Mode string `json:"mode,omitempty"`
+	MTU  int    `json:"mtu,omitempty"`
+	// IPAM is optional, an interface without IPAM has no addresses.
+	IPAM IPAM `json:"-"`
+}
+
+func (p *IPVlanPlugin) Type() string { return "ipvlan" }
+
+func (p *IPVlanPlugin) Validate() error {
+	switch p.Mode {
+	case "", "l2", "l3", "l3s":
+	default:
+		return fmt.Errorf("invalid mode %q", p.Mode)
+	}
+	if err := validateMTU(p.MTU); err != nil {
+		return err
+	}
+	return ipamConf(p.IPAM, false)
+}
+
+func (p *IPVlanPlugin) MarshalJSON() ([]byte, error) {
+	type plain IPVlanPlugin
+	return marshalWithIPAM((*plain)(p), p.IPAM)
+}
+
+// IPRange is an address range of the host-local IPAM plugin.
+type IPRange struct {
+	Subnet     string `json:"subnet"`
+	RangeStart string `json:"rangeStart,omitempty"`
+	RangeEnd   string `json:"rangeEnd,omitempty"`
+	Gateway    string `json:"gateway,omitempty"`
+}
+
+// Route is a route set up by the IPAM plugins.
+type Route struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+// HostLocalIPAM is the config of the host-local IPAM plugin.
+type HostLocalIPAM struct {
+	// Ranges are sets of ranges, an address is allocated from each set.
+	Ranges  [][]IPRange `json:"ranges"`
+	Routes  []Route     `json:"routes,omitempty"`
+	DataDir string      `json:"dataDir,omitempty"`
+}
+
+func (p *HostLocalIPAM) Type() string { return "host-local" }
+
+func (p *HostLocalIPAM) Validate() error {
+	if len(p.Ranges) == 0 {
+		return fmt.Errorf("ranges are required")
+	}
+	for _, set := range p.Ranges {
+		if len(set) == 0 {
+			return fmt.Errorf("empty range set")
+		}
+		for _, r := range set {
+			_, subnet, err := net.ParseCIDR(r.Subnet)
+			if err != nil {
+				return fmt.Errorf("invalid subnet %q", r.Subnet)
+			}
+			for _, ip := range []string{r.RangeStart, r.RangeEnd, r.Gateway} {
+				if ip != "" && !subnet.Contains(net.ParseIP(ip)) {
+					return fmt.Errorf("%q is not in subnet %s", ip, r.Subnet)
+				}
+			}
+		}
+	}
+	return validateRoutes(p.Routes)
+}
+
+// StaticAddress is an address of the static IPAM plugin.
+type StaticAddress struct {
+	// Address is in CIDR notation.
+	Address string `json:"address"`
+	Gateway string `json:"gateway,omitempty"`
+}
+
+// StaticIPAM is the config of the static IPAM plugin.
+type StaticIPAM struct {
+	Addresses []StaticAddress `json:"addresses"`
+	Routes    []Route         `json:"routes,omitempty"`
+}
+
+func (p *StaticIPAM) Type() string { return "static" }
+
+func (p *StaticIPAM) Validate() error {
+	if len(p.Addresses) == 0 {
+		return fmt.Errorf("addresses are required")
+	}
+	for _, a := range p.Addresses {
+		if _, _, err := net.ParseCIDR(a.Address); err != nil {
+			return fmt.Errorf("invalid address %q", a.Address)
+		}
+		if a.Gateway != "" && net.ParseIP(a.Gateway) == nil {
+			return fmt.Errorf("invalid gateway %q", a.Gateway)
+		}
+	}
+	return validateRoutes(p.Routes)
+}
+
+// PortMapPlugin is the config of the portmap plugin. The port mappings
+// are passed at runtime with WithCapabilityPortMap.
+type PortMapPlugin struct {
+	SNAT    *bool `json:"snat,omitempty"`
+	MasqAll bool  `json:"masqAll,omitempty"`
+}
+
+func (p *PortMapPlugin) Type() string    { return "portmap" }
+func (p *PortMapPlugin) Validate() error { return nil }
+
+func (p *PortMapPlugin) Capabilities() map[string]bool {
+	return map[string]bool{"portMappings": true}
+}
+
+// BandwidthPlugin is the config of the bandwidth plugin. The limits may
+// also be passed at runtime with WithCapabilityBandWidth. Rates are in
+// bits per second and bursts in bits.
+type BandwidthPlugin struct {
+	IngressRate  uint64 `json:"ingressRate,omitempty"`
+	IngressBurst uint64 `json:"ingressBurst,omitempty"`
+	EgressRate   uint64 `json:"egressRate,omitempty"`
+	EgressBurst  uint64 `json:"egressBurst,omitempty"`
+}
+
+func (p *BandwidthPlugin) Type() string { return "bandwidth" }
+
+func (p *BandwidthPlugin) Validate() error {
+	if (p.IngressRate == 0) != (p.IngressBurst == 0) {
+		return fmt.Errorf("ingress rate and burst must be set together")
+	}
+	if (p.EgressRate == 0) != (p.EgressBurst == 0) {
+		return fmt.Errorf("egress rate and burst must be set together")
+	}
+	return nil
+}
+
+func (p *BandwidthPlugin) Capabilities() map[string]bool {
+	return map[string]bool{"bandwidth": true}
+}
+
+// TuningPlugin is the config of the tuning plugin.
+type TuningPlugin struct {
+	Sysctl   map[string]string `json:"sysctl,omitempty"`
+	Mac      string            `json:"mac,omitempty"`
+	MTU      int               `json:"mtu,omitempty"`
+	Promisc  bool              `json:"promisc,omitempty"`
+	AllMulti bool              `json:"allmulti,omitempty"`
+}
+
+func (p *TuningPlugin) Type() string { return "tuning" }
+
+func (p *TuningPlugin) Validate() error {
+	if p.Mac != "" {
+		if _, err := net.ParseMAC(p.Mac); err != nil {
+			return fmt.Errorf("invalid mac %q", p.Mac)
+		}
+	}
+	return validateMTU(p.MTU)
+}
+
+// FirewallPlugin is the config of the firewall plugin.
+type FirewallPlugin struct {
+	// Backend is either iptables or firewalld, and is detected if empty.
+	Backend                string `json:"backend,omitempty"`
+	IptablesAdminChainName string `json:"iptablesAdminChainName,omitempty"`
+	FirewalldZone          string `json:"firewalldZone,omitempty"`
+}
+
+func (p *FirewallPlugin) Type() string { return "firewall" }
+
+func (p *FirewallPlugin) Validate() error {
+	switch p.Backend {
+	case "", "iptables", "firewalld":
+		return nil
+	default:
+		return fmt.Errorf("invalid backend %q", p.Backend)
+	}
+}
+
+// LoopbackPlugin is the config of the loopback plugin.
+type LoopbackPlugin struct{}
+
+func (p *LoopbackPlugin) Type() string    { return "loopback" }
+func (p *LoopbackPlugin) Validate() error { return nil }
+
+// marshalWithIPAM marshals the plugin config v with its ipam set.
+func marshalWithIPAM(v interface{}, ipam IPAM) ([]byte, error) {
+	bytes, err := json.Marshal(v)
+	if err != nil || ipam == nil {
+		return bytes, err
+	}
+	conf := make(map[string]interface{})
+	if err := decodeJSON(bytes, &conf); err != nil {
+		return nil, err
+	}
+	if conf["ipam"], err = rawPlugin(ipam); err != nil {
+		return nil, err
+	}
+	return json.Marshal(conf)
+}
+
+func validateMTU(mtu int) error {
+	if mtu < 0 {
+		return fmt.Errorf("invalid mtu %d", mtu)
+	}
+	return nil
+}
+
+func validateRoutes(routes []Route) error {
+	for _, r := range routes {
+		if _, _, err := net.ParseCIDR(r.Dst); err != nil {
+			return fmt.Errorf("invalid route destination %q", r.Dst)
+		}
+		if r.GW != "" && net.ParseIP(r.GW) == nil {
+			return fmt.Errorf("invalid route gateway %q", r.GW)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfListBuilder(t *testing.T) {
+	t.Parallel()
+
+	bytes, err := NewConfListBuilder("containerd-net").CNIVersion("1.1.0").Plugins(
+		&BridgePlugin{
+			Bridge:    "cni0",
+			IsGateway: true,
+			IPMasq:    true,
+			IPAM: &HostLocalIPAM{
+				Ranges: [][]IPRange{
+					{{Subnet: "10.88.0.0/16"}},
+					{{Subnet: "2001:4860:4860::/64"}},
+				},
+				Routes: []Route{{Dst: "0.0.0.0/0"}, {Dst: "::/0"}},
+			},
+		},
+		&PortMapPlugin{},
+		&BandwidthPlugin{},
+		&TuningPlugin{Sysctl: map[string]string{"net.ipv4.conf.all.arp_notify": "1"}},
+		&FirewallPlugin{},
+	).Bytes()
+	assert.NoError(t, err)
+
+	l := defaultCNIConfig()
+	assert.NoError(t, l.Load(WithConfListBytes(bytes)))
+	assert.Len(t, l.networks, 1)
+	network := l.networks[0].config
+	assert.Equal(t, "containerd-net", network.Name)
+	assert.Equal(t, "1.1.0", network.CNIVersion)
+	assert.Len(t, network.Plugins, 5)
+	assert.Equal(t, "bridge", network.Plugins[0].Network.Type)
+	assert.Equal(t, "host-local", network.Plugins[0].Network.IPAM.Type)
+	assert.Equal(t, map[string]bool{"portMappings": true}, network.Plugins[1].Network.Capabilities)
+	assert.Equal(t, map[string]bool{"bandwidth": true}, network.Plugins[2].Network.Capabilities)
+
+	var bridge map[string]interface{}
+	assert.NoError(t, json.Unmarshal(network.Plugins[0].Bytes, &bridge))
+	assert.Equal(t, "cni0", bridge["bridge"])
+	assert.Equal(t, true, bridge["isGateway"])
+	assert.NotContains(t, bridge, "mtu")
+
+	bytes, err = NewConfListBuilder("static").Plugins(&MacvlanPlugin{
+		Master: "eth0",
+		Mode:   "bridge",
+		IPAM:   &StaticIPAM{Addresses: []StaticAddress{{Address: "192.168.1.10/24", Gateway: "192.168.1.1"}}},
+	}).Bytes()
+	assert.NoError(t, err)
+	assert.NoError(t, l.Load(WithConfListBytes(bytes)))
+
+	// macvlan and ipvlan interfaces may be left without addresses.
+	for _, p := range []Plugin{&MacvlanPlugin{Master: "eth0"}, &IPVlanPlugin{Master: "eth0"}} {
+		_, err = NewConfListBuilder("no-ipam").Plugins(p).Bytes()
+		assert.NoError(t, err, p.Type())
+	}
+
+	// Large integers are not rounded through float64.
+	bytes, err = NewConfListBuilder("bandwidth").Plugins(
+		&BridgePlugin{IPAM: &HostLocalIPAM{Ranges: [][]IPRange{{{Subnet: "10.88.0.0/16"}}}}},
+		&BandwidthPlugin{IngressRate: 1<<63 + 1, IngressBurst: 1<<63 + 1},
+	).Bytes()
+	assert.NoError(t, err)
+	assert.Contains(t, string(bytes), `"ingressRate":9223372036854775809`)
+
+	for _, b := range []*ConfListBuilder{
+		NewConfListBuilder(""),
+		NewConfListBuilder("no-plugins"),
+		NewConfListBuilder("no-ipam").Plugins(&PTPPlugin{}),
+		NewConfListBuilder("bad-mode").Plugins(&IPVlanPlugin{Mode: "l4", IPAM: &StaticIPAM{Addresses: []StaticAddress{{Address: "10.0.0.1/24"}}}}),
+		NewConfListBuilder("bad-subnet").Plugins(&BridgePlugin{IPAM: &HostLocalIPAM{Ranges: [][]IPRange{{{Subnet: "10.0.0.0"}}}}}),
+		NewConfListBuilder("bad-range").Plugins(&BridgePlugin{IPAM: &HostLocalIPAM{Ranges: [][]IPRange{{{Subnet: "10.0.0.0/24", Gateway: "10.0.1.1"}}}}}),
+		NewConfListBuilder("bad-burst").Plugins(&BandwidthPlugin{IngressRate: 1000}),
+		NewConfListBuilder("bad-mac").Plugins(&TuningPlugin{Mac: "not-a-mac"}),
+		NewConfListBuilder("nil-plugin").Plugins(&LoopbackPlugin{}, nil),
+	} {
+		_, err := b.Bytes()
+		assert.ErrorIs(t, err, ErrInvalidConfig, b.name)
+	}
+}
@@ -0,0 +1,281 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	cnilibrary "github.com/containernetworking/cni/libcni"
+)
+
+// confExtensions are the extensions of the network config files.
+var confExtensions = []string{".conf", ".conflist", ".json"}
+
+// confLoader finds and parses network config files.
+type confLoader interface {
+	// confFiles returns the network config files, sorted in load order.
+	confFiles() ([]string, error)
+	// confList parses a .conflist file.
+	confList(file string) (*cnilibrary.NetworkConfigList, error)
+	// conf parses a .conf or .json file.
+	conf(file string) (*cnilibrary.NetworkConfig, error)
+	// String describes where the files are loaded from.
+	String() string
+}
+
+// dirLoader loads network config files from layered directories,
+// ordered from the lowest to the highest precedence.
+type dirLoader struct {
+	dirs []string
+	// expand, if not nil, expands the variables of the files.
+	expand func(file string, conf []byte) ([]byte, error)
+}
+
+// confFiles returns the network config files found in the directories,
+// sorted lexicographically by file name. A file shadows the files with
+// the same name in the directories before it.
+func (l *dirLoader) confFiles() ([]string, error) {
+	byName := make(map[string]string)
+	for _, dir := range l.dirs {
+		files, err := cnilibrary.ConfFiles(dir, confExtensions)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			byName[filepath.Base(f)] = f
+		}
+	}
+	return sortedFiles(byName), nil
+}
+
+func (l *dirLoader) confList(file string) (*cnilibrary.NetworkConfigList, error) {
+	if l.expand == nil {
+		return cnilibrary.ConfListFromFile(file)
+	}
+	bytes, err := l.read(file)
+	if err != nil {
+		return nil, err
+	}
+	confList, err := cnilibrary.ConfListFromBytes(bytes)
+	if err != nil {
+		return nil, err
+	}
+	// Like cnilibrary.ConfListFromFile, load the plugins stored in
+	// separate files next to the config list.
+	if !confList.LoadOnlyInlinedPlugins {
+		plugins, err := cnilibrary.NetworkPluginConfsFromFiles(filepath.Dir(file), confList.Name)
+		if err != nil {
+			return nil, err
+		}
+		confList.Plugins = append(confList.Plugins, plugins...)
+	}
+	return confList, nil
+}
+
+func (l *dirLoader) conf(file string) (*cnilibrary.NetworkConfig, error) {
+	if l.expand == nil {
+		return confFromFile(file)
+	}
+	bytes, err := l.read(file)
+	if err != nil {
+		return nil, err
+	}
+	return confFromBytes(bytes)
+}
+
+func (l *dirLoader) read(file string) ([]byte, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", file, err)
+	}
+	return l.expand(file, bytes)
+}
+
+func (l *dirLoader) String() string {
+	return strings.Join(l.dirs, ", ")
+}
+
+// fsLoader loads network config files from a directory of a fs.FS.
+type fsLoader struct {
+	fsys fs.FS
+	dir  string
+	// expand, if not nil, expands the variables of the files.
+	expand func(file string, conf []byte) ([]byte, error)
+}
+
+func (l *fsLoader) confFiles() ([]string, error) {
+	entries, err := fs.ReadDir(l.fsys, l.dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// Like a missing config directory, a missing dir is not an error.
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	byName := make(map[string]string)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		for _, ext := range confExtensions {
+			if path.Ext(e.Name()) == ext {
+				byName[e.Name()] = path.Join(l.dir, e.Name())
+			}
+		}
+	}
+	return sortedFiles(byName), nil
+}
+
+func (l *fsLoader) confList(file string) (*cnilibrary.NetworkConfigList, error) {
+	bytes, err := l.read(file)
+	if err != nil {
+		return nil, err
+	}
+	return cnilibrary.ConfListFromBytes(bytes)
+}
+
+func (l *fsLoader) conf(file string) (*cnilibrary.NetworkConfig, error) {
+	bytes, err := l.read(file)
+	if err != nil {
+		return nil, err
+	}
+	return confFromBytes(bytes)
+}
+
+func (l *fsLoader) read(file string) ([]byte, error) {
+	bytes, err := fs.ReadFile(l.fsys, file)
+	if err != nil || l.expand == nil {
+		return bytes, err
+	}
+	return l.expand(file, bytes)
+}
+
+func (l *fsLoader) String() string {
+	return l.dir
+}
+
+// sortedFiles returns the files of byName sorted by name.
+func sortedFiles(byName map[string]string) []string {
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	// Use lexicographical way as a defined order for network config files.
+	sort.Strings(names)
+	files := make([]string, 0, len(names))
+	for _, name := range names {
+		files = append(files, byName[name])
+	}
+	return files
+}
+
+// orderNetworks orders the networks loaded from the config directory with
+// the default network first, followed by the networks in priority order.
+func (c *libcni) orderNetworks(networks []*Network) ([]*Network, error) {
+	rank := make(map[string]int, len(c.networkPriority))
+	for i, name := range c.networkPriority {
+		rank[name] = i + 1
+	}
+	def := c.defaultNetwork
+	if def == "" && c.defaultNetworkMarker {
+		for _, network := range networks {
+			if !isMarkedDefault(network.config) {
+				continue
+			}
+			if def != "" {
+				return nil, fmt.Errorf("networks %s and %s are both marked as default: %w", def, network.config.Name, ErrInvalidConfig)
+			}
+			def = network.config.Name
+		}
+	}
+	if def != "" {
+		found := false
+		for _, network := range networks {
+			found = found || network.config.Name == def
+		}
+		if !found {
+			return nil, fmt.Errorf("default network %s not found: %w", def, ErrNotFound)
+		}
+		rank[def] = -1
+	}
+	// Networks without a rank keep the sorted order of files.
+	position := func(network *Network) int {
+		if r, ok := rank[network.config.Name]; ok {
+			return r
+		}
+		return len(c.networkPriority) + 1
+	}
+	sort.SliceStable(networks, func(i, j int) bool {
+		return position(networks[i]) < position(networks[j])
+	})
+	return networks, nil
+}
+
+// isMarkedDefault returns true if the config list sets DefaultNetworkKey.
+func isMarkedDefault(confList *cnilibrary.NetworkConfigList) bool {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(confList.Bytes, &raw); err != nil {
+		return false
+	}
+	marked, _ := raw[DefaultNetworkKey].(bool)
+	return marked
+}
+
+// nameFilter matches names against include and exclude patterns.
+type nameFilter struct {
+	include []string
+	exclude []string
+}
+
+func newNameFilter(include, exclude []string) (*nameFilter, error) {
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v: %w", pattern, err, ErrInvalidConfig)
+		}
+	}
+	return &nameFilter{include: include, exclude: exclude}, nil
+}
+
+// match returns true if name matches one of the include patterns, if
+// any, and none of the exclude patterns. A nil filter matches any name.
+func (f *nameFilter) match(name string) bool {
+	if f == nil {
+		return true
+	}
+	for _, pattern := range f.exclude {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
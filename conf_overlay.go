@@ -0,0 +1,299 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"path"
+
+	cnilibrary "github.com/containernetworking/cni/libcni"
+)
+
+// ConfPatch is a patch applied to the network config lists on load.
+// Exactly one of MergePatch and JSONPatch must be set.
+type ConfPatch struct {
+	// Network selects the networks to patch by name, using the
+	// path.Match syntax. An empty Network selects every network.
+	Network string
+	// PluginType selects the plugins to patch by type. If empty the
+	// patch applies to the whole config list instead.
+	PluginType string
+	// MergePatch is a RFC 7386 JSON merge patch.
+	MergePatch []byte
+	// JSONPatch is a RFC 6902 JSON patch.
+	JSONPatch []byte
+
+	merge interface{}
+	ops   []jsonPatchOp
+}
+
+// WithConfPatches can be used to patch the network config lists
+// once they are loaded, e.g. to set node specific values in configs
+// shipped by others. The patches are applied in order, and the
+// patched config lists are parsed again by libcni. GetConfig reports
+// both the original and the patched config lists.
+func WithConfPatches(patches ...ConfPatch) Opt {
+	return func(c *libcni) error {
+		var parsed []*ConfPatch
+		for i := range patches {
+			p := patches[i]
+			if _, err := path.Match(p.Network, ""); err != nil {
+				return fmt.Errorf("invalid network pattern %q: %v: %w", p.Network, err, ErrInvalidConfig)
+			}
+			switch {
+			case (p.MergePatch == nil) == (p.JSONPatch == nil):
+				return fmt.Errorf("patch %d must have either a merge patch or a JSON patch: %w", i, ErrInvalidConfig)
+			case p.MergePatch != nil:
+				if err := decodeJSON(p.MergePatch, &p.merge); err != nil {
+					return fmt.Errorf("invalid merge patch %d: %v: %w", i, err, ErrInvalidConfig)
+				}
+			default:
+				ops, err := decodeJSONPatch(p.JSONPatch)
+				if err != nil {
+					return fmt.Errorf("invalid JSON patch %d: %v: %w", i, err, ErrInvalidConfig)
+				}
+				p.ops = ops
+			}
+			parsed = append(parsed, &p)
+		}
+		c.confPatches = parsed
+		return nil
+	}
+}
+
+// patchNetworks applies the config patches to the loaded networks.
+func (c *libcni) patchNetworks() error {
+	if len(c.confPatches) == 0 {
+		return nil
+	}
+	for _, network := range c.networks {
+		var patches []*ConfPatch
+		for _, p := range c.confPatches {
+			if p.selects(network.config.Name) {
+				patches = append(patches, p)
+			}
+		}
+		if len(patches) == 0 {
+			continue
+		}
+		err := network.updateConfig(func(raw map[string]interface{}) error {
+			for _, p := range patches {
+				if err := p.apply(raw); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to patch network %s%s: %v: %w", network.config.Name, network.source(), err, ErrInvalidConfig)
+		}
+	}
+	return nil
+}
+
+// selects returns true if the patch applies to the network name.
+func (p *ConfPatch) selects(name string) bool {
+	if p.Network == "" {
+		return true
+	}
+	ok, _ := path.Match(p.Network, name)
+	return ok
+}
+
+// apply applies the patch to the raw config list.
+func (p *ConfPatch) apply(raw map[string]interface{}) error {
+	if p.PluginType == "" {
+		doc, err := p.patch(raw)
+		if err != nil {
+			return err
+		}
+		patched, ok := doc.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("patched config list is a %T", doc)
+		}
+		// The patch may have updated raw in place or replaced it.
+		patched = maps.Clone(patched)
+		clear(raw)
+		maps.Copy(raw, patched)
+		return nil
+	}
+	plugins, _ := raw["plugins"].([]interface{})
+	for i, plugin := range plugins {
+		conf, ok := plugin.(map[string]interface{})
+		if !ok || conf["type"] != p.PluginType {
+			continue
+		}
+		doc, err := p.patch(conf)
+		if err != nil {
+			return fmt.Errorf("plugin %d: %w", i, err)
+		}
+		plugins[i] = doc
+	}
+	return nil
+}
+
+func (p *ConfPatch) patch(doc interface{}) (interface{}, error) {
+	if p.ops != nil {
+		return applyJSONPatch(doc, p.ops)
+	}
+	// The merge patch is applied to several documents, so it
+	// must not end up shared between them.
+	merge, err := jsonCopy(p.merge)
+	if err != nil {
+		return nil, err
+	}
+	return mergePatch(doc, merge), nil
+}
+
+// updateConfig calls fn with the raw JSON of the network config list,
+// and replaces the config list with the result parsed by libcni. The
+// original config list is kept for GetConfig.
+func (n *Network) updateConfig(fn func(raw map[string]interface{}) error) error {
+	raw, err := rawConfList(n.config)
+	if err != nil {
+		return err
+	}
+	if err := fn(raw); err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	confList, err := cnilibrary.ConfListFromBytes(bytes)
+	if err != nil {
+		return err
+	}
+	if len(confList.Plugins) == 0 {
+		return fmt.Errorf("config list has no plugins")
+	}
+	if n.origConfig == nil {
+		n.origConfig = n.config
+	}
+	n.config = confList
+	return nil
+}
+
+// rawConfList returns the raw JSON of the config list, with every
+// plugin inlined.
+func rawConfList(confList *cnilibrary.NetworkConfigList) (map[string]interface{}, error) {
+	raw := make(map[string]interface{})
+	if err := decodeJSON(confList.Bytes, &raw); err != nil {
+		return nil, err
+	}
+	// The plugins may have been loaded from separate files.
+	plugins := make([]interface{}, 0, len(confList.Plugins))
+	for _, plugin := range confList.Plugins {
+		var conf interface{}
+		if err := decodeJSON(plugin.Bytes, &conf); err != nil {
+			return nil, err
+		}
+		plugins = append(plugins, conf)
+	}
+	raw["plugins"] = plugins
+	return raw, nil
+}
+
+// PluginInjection injects plugins in the network config lists on load.
+type PluginInjection struct {
+	// Selector selects the networks to inject the plugins in. A nil
+	// Selector selects every network but the loopback network.
+	Selector func(conf *cnilibrary.NetworkConfigList) bool
+	// Prepend injects the plugins at the start of the plugin chain
+	// instead of at its end.
+	Prepend bool
+	// Plugins are the plugin configs to inject, in order. A plugin
+	// is skipped for the networks already having a plugin of its type.
+	Plugins [][]byte
+
+	plugins []*cnilibrary.PluginConfig
+}
+
+// WithPluginInjection can be used to inject plugins in the plugin
+// chain of the network config lists once they are loaded, e.g. to
+// make every network end with the bandwidth and tuning plugins. The
+// injections are applied in order, before the config patches.
+func WithPluginInjection(injections ...PluginInjection) Opt {
+	return func(c *libcni) error {
+		var parsed []*PluginInjection
+		for i := range injections {
+			inj := injections[i]
+			inj.plugins = nil
+			for _, bytes := range inj.Plugins {
+				plugin, err := confFromBytes(bytes)
+				if err != nil {
+					return fmt.Errorf("invalid plugin config: %v: %w", err, ErrInvalidConfig)
+				}
+				inj.plugins = append(inj.plugins, plugin)
+			}
+			parsed = append(parsed, &inj)
+		}
+		c.pluginInjections = parsed
+		return nil
+	}
+}
+
+// injectPlugins applies the plugin injections to the loaded networks.
+func (c *libcni) injectPlugins() error {
+	for _, network := range c.networks {
+		for _, inj := range c.pluginInjections {
+			if !inj.selects(network) {
+				continue
+			}
+			present := make(map[string]bool, len(network.config.Plugins))
+			for _, plugin := range network.config.Plugins {
+				present[plugin.Network.Type] = true
+			}
+			var plugins []interface{}
+			for _, plugin := range inj.plugins {
+				if present[plugin.Network.Type] {
+					continue
+				}
+				var conf interface{}
+				if err := decodeJSON(plugin.Bytes, &conf); err != nil {
+					return err
+				}
+				plugins = append(plugins, conf)
+			}
+			if len(plugins) == 0 {
+				continue
+			}
+			err := network.updateConfig(func(raw map[string]interface{}) error {
+				chain, _ := raw["plugins"].([]interface{})
+				if inj.Prepend {
+					raw["plugins"] = append(plugins, chain...)
+				} else {
+					raw["plugins"] = append(chain, plugins...)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to inject plugins in network %s%s: %v: %w", network.config.Name, network.source(), err, ErrInvalidConfig)
+			}
+		}
+	}
+	return nil
+}
+
+func (inj *PluginInjection) selects(network *Network) bool {
+	if inj.Selector == nil {
+		return network.ifName != loopbackIfName
+	}
+	return inj.Selector(network.config)
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// confVarName matches the valid variable names.
+var confVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// confExpander returns the function expanding the variables of the
+// config bytes loaded from file, or nil if no variables are configured.
+func (c *libcni) confExpander() func(file string, conf []byte) ([]byte, error) {
+	if c.confVars == nil && !c.confEnvVars {
+		return nil
+	}
+	lookup := func(name string) (string, bool) {
+		if v, ok := c.confVars[name]; ok {
+			return v, true
+		}
+		if c.confEnvVars {
+			return os.LookupEnv(name)
+		}
+		return "", false
+	}
+	return func(file string, conf []byte) ([]byte, error) {
+		return expandConfVars(file, conf, lookup)
+	}
+}
+
+// expandConf expands the variables of config bytes not loaded from a file.
+func (c *libcni) expandConf(conf []byte) ([]byte, error) {
+	expand := c.confExpander()
+	if expand == nil {
+		return conf, nil
+	}
+	return expand("", conf)
+}
+
+// expandConfVars replaces the ${NAME} references of conf with the values
+// returned by lookup. The values are escaped as JSON string contents, so
+// a reference can stand for a number or be part of a string, but can not
+// add to the structure of the config. $${ is replaced by ${.
+func expandConfVars(file string, conf []byte, lookup func(string) (string, bool)) ([]byte, error) {
+	var out bytes.Buffer
+	line := 1
+	for i := 0; i < len(conf); {
+		switch {
+		case conf[i] == '\n':
+			line++
+			out.WriteByte(conf[i])
+			i++
+		case bytes.HasPrefix(conf[i:], []byte("$${")):
+			out.WriteString("${")
+			i += 3
+		case bytes.HasPrefix(conf[i:], []byte("${")):
+			end := bytes.IndexByte(conf[i+2:], '}')
+			if end < 0 {
+				return nil, confVarError(file, line, "unterminated variable reference")
+			}
+			name := string(conf[i+2 : i+2+end])
+			if !confVarName.MatchString(name) {
+				return nil, confVarError(file, line, fmt.Sprintf("invalid variable name %q", name))
+			}
+			value, ok := lookup(name)
+			if !ok {
+				return nil, confVarError(file, line, fmt.Sprintf("undefined variable %q", name))
+			}
+			writeJSONEscaped(&out, value)
+			i += 2 + end + 1
+		default:
+			out.WriteByte(conf[i])
+			i++
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// writeJSONEscaped writes value escaped as the contents of a JSON string.
+func writeJSONEscaped(out *bytes.Buffer, value string) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	// Encoding a string never fails.
+	_ = enc.Encode(value)
+	// Strip the quotes and the newline written by Encode.
+	out.Write(b.Bytes()[1 : b.Len()-2])
+}
+
+func confVarError(file string, line int, reason string) error {
+	if file == "" {
+		return fmt.Errorf("failed to expand CNI config at line %d: %s: %w", line, reason, ErrInvalidConfig)
+	}
+	return fmt.Errorf("failed to expand CNI config file %s at line %d: %s: %w", file, line, reason, ErrInvalidConfig)
+}
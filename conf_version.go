@@ -0,0 +1,169 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+
+	cnilibrary "github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// CNIVersionOverride sets the CNI version of the network config lists
+// on load.
+type CNIVersionOverride struct {
+	// Network selects the networks by name, using the path.Match
+	// syntax. An empty Network selects every network.
+	Network string
+	// Version is the CNI version to set.
+	Version string
+	// Force sets Version even if the network has a greater CNI version.
+	// Otherwise the CNI version is only raised.
+	Force bool
+}
+
+// WithCNIVersionOverride can be used to set the CNI version of the
+// loaded networks, e.g. to enable CHECK, STATUS and GC for configs
+// shipped with an old or no CNI version. The plugins of a selected
+// network are asked for their supported versions through VERSION, and
+// the network is skipped with a warning if one of them does not
+// support the CNI version. The default network, attached on the
+// default interface, is never skipped: the load fails instead. The
+// first override selecting a network applies.
+func WithCNIVersionOverride(overrides ...CNIVersionOverride) Opt {
+	return func(c *libcni) error {
+		var parsed []*CNIVersionOverride
+		for i := range overrides {
+			o := overrides[i]
+			if _, err := path.Match(o.Network, ""); err != nil {
+				return fmt.Errorf("invalid network pattern %q: %v: %w", o.Network, err, ErrInvalidConfig)
+			}
+			if _, _, _, err := version.ParseVersion(o.Version); err != nil {
+				return fmt.Errorf("invalid CNI version %q: %v: %w", o.Version, err, ErrInvalidConfig)
+			}
+			if gt, _ := version.GreaterThan(o.Version, version.Current()); gt {
+				return fmt.Errorf("CNI version %s is not supported by libcni: %w", o.Version, ErrInvalidConfig)
+			}
+			parsed = append(parsed, &o)
+		}
+		c.cniVersionOverrides = parsed
+		return nil
+	}
+}
+
+// overrideCNIVersions applies the CNI version overrides to the loaded
+// networks.
+func (c *libcni) overrideCNIVersions() error {
+	if len(c.cniVersionOverrides) == 0 {
+		return nil
+	}
+	// The plugins are only asked once per executor.
+	probed := make(map[probedPlugin][]string)
+	// Skipping the default network would leave the default interface
+	// without a network.
+	defaultIfName := c.findDefaultIfName()
+	networks := c.networks[:0]
+	for _, network := range c.networks {
+		o := c.cniVersionOverride(network)
+		if o == nil {
+			networks = append(networks, network)
+			continue
+		}
+		if err := network.supportsCNIVersion(probed, o.Version); err != nil {
+			if network.ifName == defaultIfName {
+				return fmt.Errorf("default network %s%s can not be set to CNI version %s: %v: %w", network.config.Name, network.source(), o.Version, err, ErrInvalidConfig)
+			}
+			c.warnings = append(c.warnings, &ConfWarning{
+				File:   network.confFile,
+				Reason: fmt.Sprintf("network %s can not be set to CNI version %s: %v", network.config.Name, o.Version, err),
+			})
+			continue
+		}
+		err := network.updateConfig(func(raw map[string]interface{}) error {
+			raw["cniVersion"] = o.Version
+			// libcni picks the greatest of cniVersion and cniVersions.
+			delete(raw, "cniVersions")
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set CNI version of network %s%s: %v: %w", network.config.Name, network.source(), err, ErrInvalidConfig)
+		}
+		networks = append(networks, network)
+	}
+	c.networks = networks
+	return nil
+}
+
+// cniVersionOverride returns the override to apply to the network, if
+// any.
+func (c *libcni) cniVersionOverride(network *Network) *CNIVersionOverride {
+	for _, o := range c.cniVersionOverrides {
+		if o.Network != "" {
+			if ok, _ := path.Match(o.Network, network.config.Name); !ok {
+				continue
+			}
+		}
+		if o.Force || network.config.CNIVersion == "" {
+			return o
+		}
+		if gt, err := version.GreaterThan(o.Version, network.config.CNIVersion); err != nil || gt {
+			return o
+		}
+		return nil
+	}
+	return nil
+}
+
+// probedPlugin is a plugin type run by the executor of a network, which
+// may have its own plugin directories.
+type probedPlugin struct {
+	cni        cnilibrary.CNI
+	pluginType string
+}
+
+// supportsCNIVersion returns an error if a plugin of the network does
+// not support the CNI version v. probed caches the versions supported
+// by the plugins.
+func (n *Network) supportsCNIVersion(probed map[probedPlugin][]string, v string) error {
+	for _, plugin := range n.config.Plugins {
+		types := []string{plugin.Network.Type}
+		if plugin.Network.IPAM.Type != "" {
+			types = append(types, plugin.Network.IPAM.Type)
+		}
+		for _, t := range types {
+			key := probedPlugin{cni: n.cni, pluginType: t}
+			supported, ok := probed[key]
+			if !ok {
+				ctx, cancel := context.WithTimeout(context.Background(), pluginProbeTimeout)
+				info, err := n.cni.GetVersionInfo(ctx, t)
+				cancel()
+				if err != nil {
+					return fmt.Errorf("failed to get the versions supported by plugin %s: %w", t, err)
+				}
+				supported = info.SupportedVersions()
+				probed[key] = supported
+			}
+			if !slices.Contains(supported, v) {
+				return fmt.Errorf("plugin %s does not support it", t)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	cnilibrary "github.com/containernetworking/cni/libcni"
+)
+
+// ConfWriter atomically writes network config files into a cni config
+// directory, so that concurrent loads never see a partial file.
+type ConfWriter struct {
+	mu     sync.Mutex
+	dir    string
+	marker string
+}
+
+// beforePublish, if not nil, is called before a file is renamed into
+// the cni config directory dir. It is only set by tests.
+var beforePublish func(dir, file string)
+
+// NewConfWriter returns a ConfWriter for the cni config directory dir.
+// If marker is not empty, the files written by Sync are recorded in the
+// marker file of that name in dir, and the files a previous Sync wrote
+// that are no longer part of the configs are removed. The marker must
+// not have a network config extension, as it would then be loaded.
+func NewConfWriter(dir, marker string) (*ConfWriter, error) {
+	if marker != "" {
+		if marker != filepath.Base(marker) {
+			return nil, fmt.Errorf("invalid marker file name %q: %w", marker, ErrInvalidConfig)
+		}
+		if slices.Contains(confExtensions, filepath.Ext(marker)) {
+			return nil, fmt.Errorf("marker file name %q has a network config extension: %w", marker, ErrInvalidConfig)
+		}
+	}
+	return &ConfWriter{
+		dir:    dir,
+		marker: marker,
+	}, nil
+}
+
+// Write checks the network config with the rules used to load the
+// cni config directory, and atomically writes it to dir. name is the
+// file name, without the extension unless it is one of the network
+// config extensions; the extension is otherwise .conflist for network
+// config lists and .conf for network configs. Write returns the path of
+// the written file.
+func (w *ConfWriter) Write(name string, bytes []byte) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	file, err := w.check(name, bytes)
+	if err != nil {
+		return "", err
+	}
+	if err := w.write(file, bytes); err != nil {
+		return "", err
+	}
+	return filepath.Join(w.dir, file), nil
+}
+
+// Sync checks and writes the network configs, keyed by file name as for
+// Write. If the writer has a marker, the files written by the previous
+// Sync and not part of confs are removed. They are renamed away before
+// the configs are written, so that a concurrent load never sees both a
+// file and its replacement, e.g. 20-a.conf and 20-a.conflist. Nothing is
+// written if a network config is invalid.
+func (w *ConfWriter) Sync(confs map[string][]byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	names := make([]string, 0, len(confs))
+	for name := range confs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]string, 0, len(names))
+	for _, name := range names {
+		file, err := w.check(name, confs[name])
+		if err != nil {
+			return err
+		}
+		if slices.Contains(files, file) {
+			return fmt.Errorf("duplicate network config file %s: %w", file, ErrInvalidConfig)
+		}
+		files = append(files, file)
+	}
+
+	var stale []string
+	if w.marker != "" {
+		managed, err := w.managed()
+		if err != nil {
+			return err
+		}
+		for _, file := range managed {
+			if !slices.Contains(files, file) {
+				stale = append(stale, file)
+			}
+		}
+	}
+	hidden, err := w.hide(stale)
+	if err != nil {
+		return err
+	}
+	for i, name := range names {
+		if err := w.write(files[i], confs[name]); err != nil {
+			return errors.Join(err, w.restore(hidden, files[:i]))
+		}
+	}
+	if w.marker == "" {
+		return nil
+	}
+
+	var errs []error
+	for _, file := range hidden {
+		if err := os.Remove(filepath.Join(w.dir, staleName(file))); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("failed to remove stale network config file: %w", err))
+		}
+	}
+	if err := w.write(w.marker, []byte(strings.Join(files, "\n"))); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// hide atomically renames the stale files to hidden names without a
+// network config extension, and returns the hidden files. On failure
+// the files are restored.
+func (w *ConfWriter) hide(stale []string) ([]string, error) {
+	var hidden []string
+	for _, file := range stale {
+		err := os.Rename(filepath.Join(w.dir, file), filepath.Join(w.dir, staleName(file)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to remove stale network config file: %w", err), w.restore(hidden, nil))
+		}
+		hidden = append(hidden, file)
+	}
+	if len(hidden) > 0 {
+		if err := syncDir(w.dir); err != nil {
+			return nil, errors.Join(err, w.restore(hidden, nil))
+		}
+	}
+	return hidden, nil
+}
+
+// restore renames the hidden files back, but for the files replaced
+// by one of the written files.
+func (w *ConfWriter) restore(hidden, written []string) error {
+	var errs []error
+	for _, file := range hidden {
+		replaced := slices.ContainsFunc(written, func(f string) bool {
+			return confStem(f) == confStem(file)
+		})
+		if replaced {
+			continue
+		}
+		if err := os.Rename(filepath.Join(w.dir, staleName(file)), filepath.Join(w.dir, file)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore network config file: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// staleName returns the hidden name of a stale file.
+func staleName(file string) string {
+	return "." + file + ".stale"
+}
+
+// confStem returns the file name without its extension.
+func confStem(file string) string {
+	return strings.TrimSuffix(file, filepath.Ext(file))
+}
+
+// check validates the network config and returns its file name.
+func (w *ConfWriter) check(name string, bytes []byte) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid network config file name %q: %w", name, ErrInvalidConfig)
+	}
+	if name == w.marker {
+		return "", fmt.Errorf("network config file name %q is the marker: %w", name, ErrInvalidConfig)
+	}
+	file := name
+	if !slices.Contains(confExtensions, filepath.Ext(name)) {
+		file += confExtension(bytes)
+	}
+	if _, err := parseConfFile(&bytesLoader{file: file, bytes: bytes}, file); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// write atomically writes bytes to file in dir: the bytes are written
+// and synced to a hidden temporary file, without a network config
+// extension, which is then renamed.
+func (w *ConfWriter) write(file string, bytes []byte) error {
+	tmp, err := os.CreateTemp(w.dir, "."+file+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", file, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bytes); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to chmod %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmp.Name(), err)
+	}
+	if beforePublish != nil {
+		beforePublish(w.dir, file)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(w.dir, file)); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", tmp.Name(), err)
+	}
+	return syncDir(w.dir)
+}
+
+// managed returns the files recorded in the marker.
+func (w *ConfWriter) managed() ([]string, error) {
+	bytes, err := os.ReadFile(filepath.Join(w.dir, w.marker))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read marker: %v: %w", err, ErrRead)
+	}
+	var files []string
+	for _, file := range strings.Split(string(bytes), "\n") {
+		// Never remove anything outside of dir.
+		if file != "" && file == filepath.Base(file) && file != w.marker {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// confExtension returns the extension of the network config file.
+func confExtension(bytes []byte) string {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(bytes, &raw); err == nil {
+		if _, ok := raw["plugins"]; ok {
+			return ".conflist"
+		}
+	}
+	return ".conf"
+}
+
+// syncDir syncs the directory, making the renames in it durable.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", dir, err)
+	}
+	return nil
+}
+
+// bytesLoader parses a single network config file held in memory.
+type bytesLoader struct {
+	file  string
+	bytes []byte
+}
+
+func (l *bytesLoader) confFiles() ([]string, error) {
+	return []string{l.file}, nil
+}
+
+func (l *bytesLoader) confList(string) (*cnilibrary.NetworkConfigList, error) {
+	return cnilibrary.ConfListFromBytes(l.bytes)
+}
+
+func (l *bytesLoader) conf(string) (*cnilibrary.NetworkConfig, error) {
+	return confFromBytes(l.bytes)
+}
+
+func (l *bytesLoader) String() string {
+	return l.file
+}
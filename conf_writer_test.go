@@ -0,0 +1,134 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfWriter(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeFakeConfFile(t, dir, "05-unmanaged.conf", `{"cniVersion": "1.0.0", "name": "unmanaged", "type": "bridge"}`)
+	w, err := NewConfWriter(dir, ".managed")
+	assert.NoError(t, err)
+
+	file, err := w.Write("10-net", []byte(`{"cniVersion": "1.0.0", "name": "net", "plugins": [{"type": "bridge"}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "10-net.conflist"), file)
+
+	err = w.Sync(map[string][]byte{
+		"20-a":      []byte(`{"cniVersion": "1.0.0", "name": "a", "type": "ptp"}`),
+		"30-b.json": []byte(`{"cniVersion": "1.0.0", "name": "b", "type": "macvlan"}`),
+	})
+	assert.NoError(t, err)
+	assertDirFiles(t, dir, "05-unmanaged.conf", "10-net.conflist", "20-a.conf", "30-b.json")
+
+	l := defaultCNIConfig()
+	l.pluginConfDir = dir
+	assert.NoError(t, l.Load(WithAllConf))
+	assert.Len(t, l.networks, 4)
+
+	// Only the files of the previous Sync are stale.
+	err = w.Sync(map[string][]byte{
+		"20-a": []byte(`{"cniVersion": "1.0.0", "name": "a", "plugins": [{"type": "ptp"}]}`),
+	})
+	assert.NoError(t, err)
+	assertDirFiles(t, dir, "05-unmanaged.conf", "10-net.conflist", "20-a.conflist")
+
+	// Invalid configs are never written.
+	for name, conf := range map[string]string{
+		"40-no-type":    `{"cniVersion": "1.0.0", "name": "no-type"}`,
+		"40-no-plugins": `{"cniVersion": "1.0.0", "name": "no-plugins", "plugins": []}`,
+		"40-garbage":    `not json`,
+		"../40-escape":  `{"cniVersion": "1.0.0", "name": "escape", "type": "bridge"}`,
+		".managed":      `{"cniVersion": "1.0.0", "name": "marker", "type": "bridge"}`,
+	} {
+		_, err := w.Write(name, []byte(conf))
+		assert.ErrorIs(t, err, ErrInvalidConfig, name)
+	}
+	err = w.Sync(map[string][]byte{
+		"50-valid":   []byte(`{"cniVersion": "1.0.0", "name": "valid", "type": "bridge"}`),
+		"50-invalid": []byte(`{"cniVersion": "1.0.0", "name": "invalid"}`),
+	})
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+	assertDirFiles(t, dir, "05-unmanaged.conf", "10-net.conflist", "20-a.conflist")
+
+	// The stale files are restored if a config can not be written.
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "60-dir.conf"), 0o755))
+	err = w.Sync(map[string][]byte{
+		"55-b":   []byte(`{"cniVersion": "1.0.0", "name": "b", "type": "bridge"}`),
+		"60-dir": []byte(`{"cniVersion": "1.0.0", "name": "dir", "type": "bridge"}`),
+	})
+	assert.Error(t, err)
+	assertDirFiles(t, dir, "05-unmanaged.conf", "10-net.conflist", "20-a.conflist", "55-b.conf", "60-dir.conf")
+}
+
+// TestConfWriterPublishOrder is not parallel as it sets beforePublish.
+func TestConfWriterPublishOrder(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewConfWriter(dir, ".managed")
+	assert.NoError(t, err)
+	err = w.Sync(map[string][]byte{
+		"20-a": []byte(`{"cniVersion": "1.0.0", "name": "a", "type": "ptp"}`),
+	})
+	assert.NoError(t, err)
+
+	// The stale files are gone before their replacement is published.
+	published := 0
+	beforePublish = func(publishDir, file string) {
+		if publishDir == dir && file == "20-a.conflist" {
+			published++
+			assert.NoFileExists(t, filepath.Join(dir, "20-a.conf"))
+		}
+	}
+	t.Cleanup(func() { beforePublish = nil })
+	err = w.Sync(map[string][]byte{
+		"20-a": []byte(`{"cniVersion": "1.0.0", "name": "a", "plugins": [{"type": "ptp"}]}`),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, published)
+	assertDirFiles(t, dir, "20-a.conflist")
+}
+
+func TestConfWriterMarker(t *testing.T) {
+	t.Parallel()
+
+	for _, marker := range []string{"managed.conf", "managed.conflist", "managed.json", "../managed"} {
+		_, err := NewConfWriter(t.TempDir(), marker)
+		assert.ErrorIs(t, err, ErrInvalidConfig, marker)
+	}
+}
+
+// assertDirFiles asserts the visible files of dir are files.
+func assertDirFiles(t *testing.T, dir string, files ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		if e.Name()[0] != '.' {
+			names = append(names, e.Name())
+		}
+	}
+	assert.Equal(t, files, names)
+}
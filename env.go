@@ -0,0 +1,107 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// cniEnvVars are the variables of the CNI protocol, always passed to
+// the plugins.
+var cniEnvVars = []string{"CNI_COMMAND", "CNI_CONTAINERID", "CNI_NETNS", "CNI_IFNAME", "CNI_ARGS", "CNI_PATH"}
+
+// PluginEnv sets the environment of the plugin processes. The variables
+// of the CNI protocol are always passed, and can not be set.
+type PluginEnv struct {
+	// Clear removes the variables of the environment, but for the ones
+	// in Allow.
+	Clear bool
+	// Allow are the names of the variables kept when Clear is set.
+	Allow []string
+	// Set are the variables set, overriding the existing ones.
+	Set map[string]string
+}
+
+// WithPluginEnv can be used to set the environment of the plugin
+// processes, which is otherwise the environment of the process. The
+// environment of the networks loaded with WithNetworkPlugins is set by
+// env first, then by the PluginEnv of the network.
+func WithPluginEnv(env PluginEnv) Opt {
+	return func(c *libcni) error {
+		if err := env.validate(); err != nil {
+			return err
+		}
+		c.pluginEnv = env.clone()
+		return nil
+	}
+}
+
+func (e *PluginEnv) validate() error {
+	for _, name := range e.Allow {
+		if name == "" || strings.Contains(name, "=") {
+			return fmt.Errorf("invalid environment variable name %q: %w", name, ErrInvalidConfig)
+		}
+	}
+	for name := range e.Set {
+		if name == "" || strings.Contains(name, "=") {
+			return fmt.Errorf("invalid environment variable name %q: %w", name, ErrInvalidConfig)
+		}
+		if slices.Contains(cniEnvVars, name) {
+			return fmt.Errorf("environment variable %s is set by libcni: %w", name, ErrInvalidConfig)
+		}
+	}
+	return nil
+}
+
+func (e *PluginEnv) clone() *PluginEnv {
+	return &PluginEnv{
+		Clear: e.Clear,
+		Allow: slices.Clone(e.Allow),
+		Set:   maps.Clone(e.Set),
+	}
+}
+
+// apply returns environ with the environment set.
+func (e *PluginEnv) apply(environ []string) []string {
+	if e == nil {
+		return environ
+	}
+	var env []string
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if _, ok := e.Set[name]; ok {
+			continue
+		}
+		if e.Clear && !slices.Contains(cniEnvVars, name) && !slices.Contains(e.Allow, name) {
+			continue
+		}
+		env = append(env, kv)
+	}
+	names := make([]string, 0, len(e.Set))
+	for name := range e.Set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+e.Set[name])
+	}
+	return env
+}
@@ -0,0 +1,77 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPluginEnv(t *testing.T) {
+	t.Setenv("GOCNI_TEST_SECRET", "leaked")
+	t.Setenv("HTTPS_PROXY", "http://proxy:3128")
+
+	pluginDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(pluginDir, "bridge"), []byte("bridge"), 0o755))
+	output := []byte(`{"cniVersion": "1.0.0", "supportedVersions": ["1.0.0"]}`)
+	globalExec, vendorExec := &fakeExec{output: output}, &fakeExec{output: output}
+
+	c, err := New(
+		WithPluginDir([]string{pluginDir}),
+		WithPluginEnv(PluginEnv{
+			Clear: true,
+			Allow: []string{"HTTPS_PROXY"},
+			Set:   map[string]string{"LOG_LEVEL": "info"},
+		}),
+		WithNetworkPlugins(NetworkPlugins{Exec: globalExec},
+			WithConfListBytes([]byte(`{"cniVersion": "1.0.0", "name": "global", "plugins": [{"type": "bridge"}]}`)),
+		),
+		WithNetworkPlugins(NetworkPlugins{
+			Exec: vendorExec,
+			Env:  &PluginEnv{Set: map[string]string{"LOG_LEVEL": "debug", "VENDOR_FLAG": "1"}},
+		}, WithConfListBytes([]byte(`{"cniVersion": "1.0.0", "name": "vendor", "plugins": [{"type": "bridge"}]}`))),
+	)
+	assert.NoError(t, err)
+	l := c.(*libcni)
+
+	ctx := context.Background()
+	_, err = l.networks[0].cni.GetVersionInfo(ctx, "bridge")
+	assert.NoError(t, err)
+	assert.Contains(t, globalExec.environ, "CNI_COMMAND=VERSION")
+	assert.Contains(t, globalExec.environ, "HTTPS_PROXY=http://proxy:3128")
+	assert.Contains(t, globalExec.environ, "LOG_LEVEL=info")
+	assert.NotContains(t, globalExec.environ, "GOCNI_TEST_SECRET=leaked")
+	assert.NotContains(t, globalExec.environ, "VENDOR_FLAG=1")
+
+	_, err = l.networks[1].cni.GetVersionInfo(ctx, "bridge")
+	assert.NoError(t, err)
+	assert.Contains(t, vendorExec.environ, "CNI_COMMAND=VERSION")
+	assert.Contains(t, vendorExec.environ, "HTTPS_PROXY=http://proxy:3128")
+	assert.Contains(t, vendorExec.environ, "LOG_LEVEL=debug")
+	assert.Contains(t, vendorExec.environ, "VENDOR_FLAG=1")
+	assert.NotContains(t, vendorExec.environ, "LOG_LEVEL=info")
+	assert.NotContains(t, vendorExec.environ, "GOCNI_TEST_SECRET=leaked")
+
+	_, err = New(WithPluginEnv(PluginEnv{Set: map[string]string{"CNI_ARGS": "IgnoreUnknown=1"}}))
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+	_, err = New(WithNetworkPlugins(NetworkPlugins{Env: &PluginEnv{Allow: []string{"A=B"}}}))
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
@@ -27,6 +27,7 @@ var (
 	ErrRead              = errors.New("failed to read config file")
 	ErrInvalidResult     = errors.New("invalid result")
 	ErrLoad              = errors.New("failed to load cni config")
+	ErrNotExecutable     = errors.New("not executable")
 )
 
 // IsCNINotInitialized returns true if the error is due to cni config not being initialized
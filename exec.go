@@ -0,0 +1,57 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+)
+
+// pluginExec is the invoke.Exec running the plugins. It checks the
+// plugin binaries against the allowlist, if any, before running them,
+// and sets their environment. The default executor also runs the
+// checked binary where possible, applies the plugin resources and
+// records the plugin usage. The config is read
+// when the plugins run, with the libcni lock held.
+type pluginExec struct {
+	invoke.Exec
+	config *config
+	// env is the environment of the network, set after the global one.
+	env *PluginEnv
+	// defaultExec is set if Exec is the default executor.
+	defaultExec bool
+}
+
+func (e *pluginExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	// binary is the verified plugin binary, if there is an allowlist.
+	var binary *os.File
+	if allowlist := e.config.pluginAllowlist; allowlist != nil {
+		f, err := allowlist.open(pluginPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		binary = f
+	}
+	environ = e.env.apply(e.config.pluginEnv.apply(environ))
+	if e.defaultExec && (binary != nil || e.config.pluginResources != nil || e.config.pluginUsageFunc != nil) {
+		return e.config.runPlugin(ctx, pluginPath, binary, stdinData, environ)
+	}
+	return e.Exec.ExecPlugin(ctx, pluginPath, stdinData, environ)
+}
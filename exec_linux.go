@@ -0,0 +1,31 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"os"
+	"os/exec"
+)
+
+// execBinary makes cmd run the opened binary instead of the file at
+// cmd.Path. The binary is passed to the process as its first extra
+// file, which stays open across exec so that the interpreter of a
+// script can read it.
+func execBinary(cmd *exec.Cmd, binary *os.File) {
+	cmd.ExtraFiles = []*os.File{binary}
+	cmd.Path = "/proc/self/fd/3"
+}
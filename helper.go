@@ -18,10 +18,23 @@ package cni
 
 import (
 	"fmt"
+	"time"
 
+	cnilibrary "github.com/containernetworking/cni/libcni"
 	types100 "github.com/containernetworking/cni/pkg/types/100"
 )
 
+// loopbackIfName is the interface name of the loopback network.
+const loopbackIfName = "lo"
+
+// defaultLoCNIVersion is the CNI version of the default loopback
+// network config if the loopback plugin can not be queried.
+const defaultLoCNIVersion = "0.3.1"
+
+// pluginProbeTimeout bounds the VERSION calls made to the plugins while
+// loading the networks.
+const pluginProbeTimeout = 10 * time.Second
+
 func validateInterfaceConfig(ipConf *types100.IPConfig, ifs int) error {
 	if ipConf == nil {
 		return fmt.Errorf("invalid IP configuration (nil)")
@@ -36,6 +49,14 @@ func getIfName(prefix string, i int) string {
 	return fmt.Sprintf("%s%d", prefix, i)
 }
 
+// ifName returns the interface name of the network conf loaded at index i.
+func (c *libcni) ifName(i int, conf *cnilibrary.NetworkConfigList) string {
+	if c.ifNameFunc != nil {
+		return c.ifNameFunc(i, conf)
+	}
+	return getIfName(c.prefix, i)
+}
+
 func defaultInterface(prefix string) string {
 	return getIfName(prefix, 0)
 }
@@ -0,0 +1,299 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// mergePatch applies the RFC 7386 JSON merge patch to the decoded
+// JSON document target and returns the patched document.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+// jsonPatchOp is an operation of a RFC 6902 JSON patch.
+type jsonPatchOp struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from,omitempty"`
+	Value *json.RawMessage `json:"value,omitempty"`
+}
+
+// decodeJSONPatch decodes and validates a RFC 6902 JSON patch.
+func decodeJSONPatch(patch []byte) ([]jsonPatchOp, error) {
+	var ops []jsonPatchOp
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, err
+	}
+	for _, op := range ops {
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("%s operation on %q has no value", op.Op, op.Path)
+			}
+		case "remove", "move", "copy":
+		default:
+			return nil, fmt.Errorf("unknown operation %q", op.Op)
+		}
+		if _, err := jsonPointer(op.Path); err != nil {
+			return nil, err
+		}
+		if op.Op == "move" || op.Op == "copy" {
+			if _, err := jsonPointer(op.From); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ops, nil
+}
+
+// applyJSONPatch applies the RFC 6902 JSON patch operations to the
+// decoded JSON document doc and returns the patched document.
+func applyJSONPatch(doc interface{}, ops []jsonPatchOp) (interface{}, error) {
+	var err error
+	for _, op := range ops {
+		path, _ := jsonPointer(op.Path)
+		var value interface{}
+		if op.Value != nil {
+			if err := decodeJSON(*op.Value, &value); err != nil {
+				return nil, err
+			}
+		}
+		switch op.Op {
+		case "add":
+			doc, err = jsonAdd(doc, path, value)
+		case "remove":
+			doc, _, err = jsonRemove(doc, path)
+		case "replace":
+			if doc, _, err = jsonRemove(doc, path); err == nil {
+				doc, err = jsonAdd(doc, path, value)
+			}
+		case "move":
+			from, _ := jsonPointer(op.From)
+			var v interface{}
+			if doc, v, err = jsonRemove(doc, from); err == nil {
+				doc, err = jsonAdd(doc, path, v)
+			}
+		case "copy":
+			from, _ := jsonPointer(op.From)
+			var v interface{}
+			if v, err = jsonGet(doc, from); err == nil {
+				if v, err = jsonCopy(v); err == nil {
+					doc, err = jsonAdd(doc, path, v)
+				}
+			}
+		case "test":
+			var v interface{}
+			if v, err = jsonGet(doc, path); err == nil && !reflect.DeepEqual(v, value) {
+				err = fmt.Errorf("test operation on %q failed", op.Path)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s operation on %q: %w", op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// jsonPointer splits a RFC 6901 JSON pointer into its unescaped tokens.
+func jsonPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// jsonGet returns the value at path in doc.
+func jsonGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q not found", token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := jsonIndex(token, len(d)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("can not get %q of a %T", token, doc)
+		}
+	}
+	return doc, nil
+}
+
+// jsonAdd adds value at path in doc and returns the updated doc.
+func jsonAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return jsonUpdate(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[token] = value
+			return p, nil
+		case []interface{}:
+			if token == "-" {
+				return append(p, value), nil
+			}
+			i, err := jsonIndex(token, len(p))
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = value
+			return p, nil
+		default:
+			return nil, fmt.Errorf("can not add %q to a %T", token, parent)
+		}
+	})
+}
+
+// jsonRemove removes the value at path in doc and returns the updated
+// doc and the removed value.
+func jsonRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("can not remove the whole document")
+	}
+	var removed interface{}
+	doc, err := jsonUpdate(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			v, ok := p[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q not found", token)
+			}
+			removed = v
+			delete(p, token)
+			return p, nil
+		case []interface{}:
+			i, err := jsonIndex(token, len(p)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = p[i]
+			return append(p[:i], p[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("can not remove %q from a %T", token, parent)
+		}
+	})
+	return doc, removed, err
+}
+
+// jsonUpdate calls fn with the parent of path and its last token, and
+// replaces the parent with the value returned by fn.
+func jsonUpdate(doc interface{}, path []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("member %q not found", path[0])
+		}
+		child, err := jsonUpdate(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		d[path[0]] = child
+		return d, nil
+	case []interface{}:
+		i, err := jsonIndex(path[0], len(d)-1)
+		if err != nil {
+			return nil, err
+		}
+		child, err := jsonUpdate(d[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		d[i] = child
+		return d, nil
+	default:
+		return nil, fmt.Errorf("can not get %q of a %T", path[0], doc)
+	}
+}
+
+// jsonIndex parses an array index token, which must not exceed last.
+func jsonIndex(token string, last int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > last || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return i, nil
+}
+
+// jsonCopy returns a deep copy of a decoded JSON value.
+func jsonCopy(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var c interface{}
+	err = decodeJSON(data, &c)
+	return c, err
+}
+
+// decodeJSON decodes data into v like json.Unmarshal, but keeps the
+// numbers as json.Number, so that they are written back unchanged
+// instead of being rounded to a float64.
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return errors.New("invalid data after top-level value")
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyJSONPatch(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+		err   string
+	}{
+		{
+			name:  "add member",
+			doc:   `{"a": 1}`,
+			patch: `[{"op": "add", "path": "/b", "value": {"c": [1, 2]}}]`,
+			want:  `{"a": 1, "b": {"c": [1, 2]}}`,
+		},
+		{
+			name:  "add array element",
+			doc:   `{"a": [1, 3]}`,
+			patch: `[{"op": "add", "path": "/a/1", "value": 2}, {"op": "add", "path": "/a/3", "value": 4}]`,
+			want:  `{"a": [1, 2, 3, 4]}`,
+		},
+		{
+			name:  "add to the end of an array",
+			doc:   `{"a": [1]}`,
+			patch: `[{"op": "add", "path": "/a/-", "value": 2}]`,
+			want:  `{"a": [1, 2]}`,
+		},
+		{
+			name:  "replace",
+			doc:   `{"a": {"b": 1}, "c": [1, 2]}`,
+			patch: `[{"op": "replace", "path": "/a/b", "value": 2}, {"op": "replace", "path": "/c/1", "value": 3}]`,
+			want:  `{"a": {"b": 2}, "c": [1, 3]}`,
+		},
+		{
+			name:  "replace missing member",
+			doc:   `{"a": 1}`,
+			patch: `[{"op": "replace", "path": "/b", "value": 2}]`,
+			err:   `member "b" not found`,
+		},
+		{
+			name:  "replace whole document",
+			doc:   `{"a": 1}`,
+			patch: `[{"op": "replace", "path": "", "value": 2}]`,
+			err:   "can not remove the whole document",
+		},
+		{
+			name:  "remove",
+			doc:   `{"a": 1, "b": [1, 2, 3]}`,
+			patch: `[{"op": "remove", "path": "/a"}, {"op": "remove", "path": "/b/1"}]`,
+			want:  `{"b": [1, 3]}`,
+		},
+		{
+			name:  "move",
+			doc:   `{"a": {"b": 1}, "c": [1, 2]}`,
+			patch: `[{"op": "move", "from": "/a/b", "path": "/d"}, {"op": "move", "from": "/c/0", "path": "/c/-"}]`,
+			want:  `{"a": {}, "c": [2, 1], "d": 1}`,
+		},
+		{
+			name:  "copy",
+			doc:   `{"a": {"b": [1]}}`,
+			patch: `[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "add", "path": "/c/b/-", "value": 2}]`,
+			want:  `{"a": {"b": [1]}, "c": {"b": [1, 2]}}`,
+		},
+		{
+			name:  "test",
+			doc:   `{"a": {"b": [1, "x"]}}`,
+			patch: `[{"op": "test", "path": "/a", "value": {"b": [1, "x"]}}]`,
+			want:  `{"a": {"b": [1, "x"]}}`,
+		},
+		{
+			name:  "test failure",
+			doc:   `{"a": 1}`,
+			patch: `[{"op": "test", "path": "/a", "value": 2}]`,
+			err:   `test operation on "/a" failed`,
+		},
+		{
+			name:  "escaped tokens",
+			doc:   `{"a/b": 1, "c~d": 2, "e~1f": 3}`,
+			patch: `[{"op": "replace", "path": "/a~1b", "value": 4}, {"op": "replace", "path": "/c~0d", "value": 5}, {"op": "remove", "path": "/e~01f"}]`,
+			want:  `{"a/b": 4, "c~d": 5}`,
+		},
+		{
+			name:  "add out of range",
+			doc:   `{"a": [1, 2]}`,
+			patch: `[{"op": "add", "path": "/a/3", "value": 3}]`,
+			err:   `invalid array index "3"`,
+		},
+		{
+			name:  "remove out of range",
+			doc:   `{"a": [1, 2]}`,
+			patch: `[{"op": "remove", "path": "/a/2"}]`,
+			err:   `invalid array index "2"`,
+		},
+		{
+			name:  "negative index",
+			doc:   `{"a": [1, 2]}`,
+			patch: `[{"op": "replace", "path": "/a/-1", "value": 3}]`,
+			err:   `invalid array index "-1"`,
+		},
+		{
+			name:  "leading zero index",
+			doc:   `{"a": [1, 2]}`,
+			patch: `[{"op": "remove", "path": "/a/01"}]`,
+			err:   `invalid array index "01"`,
+		},
+		{
+			name:  "get end of an array",
+			doc:   `{"a": [1, 2]}`,
+			patch: `[{"op": "copy", "from": "/a/-", "path": "/b"}]`,
+			err:   `invalid array index "-"`,
+		},
+		{
+			name:  "large integers",
+			doc:   `{"a": 9007199254740993, "b": 1}`,
+			patch: `[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "replace", "path": "/b", "value": 18446744073709551615}]`,
+			want:  `{"a": 9007199254740993, "b": 18446744073709551615, "c": 9007199254740993}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var doc interface{}
+			assert.NoError(t, decodeJSON([]byte(tc.doc), &doc))
+			ops, err := decodeJSONPatch([]byte(tc.patch))
+			assert.NoError(t, err)
+			doc, err = applyJSONPatch(doc, ops)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assertJSONNumbersEqual(t, tc.want, doc)
+		})
+	}
+}
+
+func TestDecodeJSONPatch(t *testing.T) {
+	t.Parallel()
+
+	for patch, err := range map[string]string{
+		`[{"op": "add", "path": "/a"}]`:                     `add operation on "/a" has no value`,
+		`[{"op": "increment", "path": "/a"}]`:               `unknown operation "increment"`,
+		`[{"op": "remove", "path": "a"}]`:                   `invalid JSON pointer "a"`,
+		`[{"op": "move", "from": "a", "path": "/a"}]`:       `invalid JSON pointer "a"`,
+		`{"op": "remove", "path": "/a"}`:                    "cannot unmarshal object",
+		`[{"op": "copy", "from": "/a", "path": "/b"}] junk`: "invalid character",
+	} {
+		_, e := decodeJSONPatch([]byte(patch))
+		assert.ErrorContains(t, e, err, patch)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	t.Parallel()
+
+	var doc, patch interface{}
+	assert.NoError(t, decodeJSON([]byte(`{"a": {"b": 1, "c": 2}, "d": [1], "e": 9007199254740993}`), &doc))
+	assert.NoError(t, decodeJSON([]byte(`{"a": {"b": null, "f": 3}, "d": {"g": 4}, "h": "i"}`), &patch))
+	assertJSONNumbersEqual(t, `{"a": {"c": 2, "f": 3}, "d": {"g": 4}, "e": 9007199254740993, "h": "i"}`, mergePatch(doc, patch))
+}
+
+func TestUpdateConfigNumbers(t *testing.T) {
+	t.Parallel()
+
+	l := defaultCNIConfig()
+	err := l.Load(WithConfListBytes([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "net",
+		"id": 9007199254740993,
+		"plugins": [{"type": "my-plugin"}]
+	}`)), WithConfPatches(ConfPatch{
+		PluginType: "my-plugin",
+		MergePatch: []byte(`{"mtu": 1450}`),
+	}))
+	assert.NoError(t, err)
+	var raw map[string]interface{}
+	assert.NoError(t, decodeJSON(l.networks[0].config.Bytes, &raw))
+	assert.Equal(t, json.Number("9007199254740993"), raw["id"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"type": "my-plugin", "mtu": json.Number("1450")}}, raw["plugins"])
+}
+
+// assertJSONNumbersEqual asserts that the decoded JSON value got is
+// want, comparing the numbers exactly unlike assert.JSONEq.
+func assertJSONNumbersEqual(t *testing.T, want string, got interface{}) {
+	t.Helper()
+	bytes, err := json.Marshal(got)
+	assert.NoError(t, err)
+	var w, g interface{}
+	assert.NoError(t, decodeJSON([]byte(want), &w))
+	assert.NoError(t, decodeJSON(bytes, &g))
+	assert.Equal(t, w, g)
+}
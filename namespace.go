@@ -18,6 +18,7 @@ package cni
 
 import (
 	"context"
+	"errors"
 
 	cnilibrary "github.com/containernetworking/cni/libcni"
 	types100 "github.com/containernetworking/cni/pkg/types/100"
@@ -27,6 +28,21 @@ type Network struct {
 	cni    cnilibrary.CNI
 	config *cnilibrary.NetworkConfigList
 	ifName string
+	// confFile is the file the network was loaded from, if any.
+	confFile string
+	// origConfig is the config as loaded, before it was modified.
+	origConfig *cnilibrary.NetworkConfigList
+	// pluginDirs are the plugin directories of the network, if it does
+	// not use the global ones.
+	pluginDirs []string
+}
+
+// source describes where the network was loaded from, for errors.
+func (n *Network) source() string {
+	if n.confFile == "" {
+		return ""
+	}
+	return " in " + n.confFile
 }
 
 func (n *Network) Attach(ctx context.Context, ns *Namespace) (*types100.Result, error) {
@@ -37,6 +53,22 @@ func (n *Network) Attach(ctx context.Context, ns *Namespace) (*types100.Result,
 	return types100.NewResultFromResult(r)
 }
 
+// reuse returns the result cached for a previous attach of the network to
+// the namespace, after verifying the attachment with CHECK. It returns
+// ErrNotFound if the network is not attached yet.
+func (n *Network) reuse(ctx context.Context, ns *Namespace) (*types100.Result, error) {
+	rt := ns.config(n.ifName)
+	r, err := cachedResult(n.cni, n.config, rt)
+	if err != nil {
+		return nil, err
+	}
+	// Attachments of networks older than 0.4.0 can not be verified.
+	if err := n.cni.CheckNetworkList(ctx, n.config, rt); err != nil && !errors.Is(err, cnilibrary.ErrorCheckNotSupp) {
+		return nil, err
+	}
+	return r, nil
+}
+
 func (n *Network) Remove(ctx context.Context, ns *Namespace) error {
 	return n.cni.DelNetworkList(ctx, n.config, ns.config(n.ifName))
 }
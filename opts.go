@@ -17,10 +17,16 @@
 package cni
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
-	"sort"
+	"path"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	cnilibrary "github.com/containernetworking/cni/libcni"
 	"github.com/containernetworking/cni/pkg/invoke"
@@ -39,18 +45,114 @@ func WithInterfacePrefix(prefix string) Opt {
 	}
 }
 
+// WithIfNameFunc can be used to name the network interfaces
+// with fn instead of the prefix followed by the load index, e.g.
+// to derive stable names from the network names. fn is called by
+// every load option except WithLoNetwork, with the index the
+// interface would otherwise be named after.
+func WithIfNameFunc(fn IfNameFunc) Opt {
+	return func(c *libcni) error {
+		c.ifNameFunc = fn
+		return nil
+	}
+}
+
 // WithPluginDir can be used to set the locations of
 // the cni plugin binaries
 func WithPluginDir(dirs []string) Opt {
 	return func(c *libcni) error {
 		c.pluginDirs = dirs
-		c.cniConfig = cnilibrary.NewCNIConfig(
-			dirs,
-			&invoke.DefaultExec{
-				RawExec:       &invoke.RawExec{Stderr: os.Stderr},
-				PluginDecoder: version.PluginDecoder{},
-			},
-		)
+		c.cniConfig = c.newCNIConfig()
+		return nil
+	}
+}
+
+// WithVendorPluginDir can be used to look for the cni plugin
+// binaries in the plugin directory of vendor under root, before
+// DefaultCNIDir. The directory is appended to the plugin directories
+// if they do not include DefaultCNIDir.
+func WithVendorPluginDir(root, vendor string) Opt {
+	return func(c *libcni) error {
+		if vendor == "" {
+			return fmt.Errorf("vendor is required: %w", ErrInvalidConfig)
+		}
+		dir := vendorCNIDir(root, vendor)
+		if slices.Contains(c.pluginDirs, dir) {
+			return nil
+		}
+		dirs := slices.Clone(c.pluginDirs)
+		if i := slices.Index(dirs, DefaultCNIDir); i >= 0 {
+			dirs = slices.Insert(dirs, i, dir)
+		} else {
+			dirs = append(dirs, dir)
+		}
+		return WithPluginDir(dirs)(c)
+	}
+}
+
+// WithPluginCheck can be used to make Status fail with a
+// *PluginError when a plugin binary used by the loaded networks
+// is missing from the plugin directories or is not executable.
+func WithPluginCheck(c *libcni) error {
+	c.checkPlugins = true
+	return nil
+}
+
+// NetworkPlugins selects how the plugins of networks are found and run.
+type NetworkPlugins struct {
+	// Dirs are the plugin directories. If empty the plugin directories
+	// set with WithPluginDir are used.
+	Dirs []string
+	// Exec runs the plugins. If nil the default executor is used. The
+	// plugin allowlist applies to both.
+	Exec invoke.Exec
+	// Env sets the environment of the plugins, after the one set with
+	// WithPluginEnv.
+	Env *PluginEnv
+}
+
+// WithNetworkPlugins can be used to load networks with opts, e.g.
+// WithConfListFile or WithConfFS, whose plugins are found and run as
+// set by plugins instead of with the global plugin directories.
+func WithNetworkPlugins(plugins NetworkPlugins, opts ...Opt) Opt {
+	return func(c *libcni) error {
+		if plugins.Env != nil {
+			if err := plugins.Env.validate(); err != nil {
+				return err
+			}
+			plugins.Env = plugins.Env.clone()
+		}
+		dirs := plugins.Dirs
+		if len(dirs) == 0 {
+			dirs = c.pluginDirs
+		}
+		cniConfig, networkCNI := c.cniConfig, c.newNetworkCNIConfig(dirs, plugins.Exec, plugins.Env)
+		first := len(c.networks)
+		// The loaded networks use c.cniConfig.
+		c.cniConfig = networkCNI
+		defer func() {
+			c.cniConfig = cniConfig
+		}()
+		for _, o := range opts {
+			if err := o(c); err != nil {
+				return err
+			}
+		}
+		for _, network := range c.networks[first:] {
+			network.cni = networkCNI
+			network.pluginDirs = dirs
+		}
+		return nil
+	}
+}
+
+// WithCacheDir can be used to configure the directory
+// libcni uses to cache results and configs of attachments.
+// By default the libcni cache directory is used.
+func WithCacheDir(dir string) Opt {
+	return func(c *libcni) error {
+		c.cacheDir = dir
+		c.cniConfig = c.newCNIConfig()
 		return nil
 	}
 }
@@ -60,6 +162,26 @@ func WithPluginDir(dirs []string) Opt {
 func WithPluginConfDir(dir string) Opt {
 	return func(c *libcni) error {
 		c.pluginConfDir = dir
+		c.pluginConfDirs = nil
+		return nil
+	}
+}
+
+// WithPluginConfDirs can be used to configure layered cni
+// configuration directories, ordered from the lowest to the
+// highest precedence. A config file shadows the files with the
+// same name in the lower layers. Network names are only checked
+// for uniqueness among the loaded networks, so a duplicate in a
+// file skipped by the max conf num goes undetected. The highest
+// precedence directory is reported as the plugin configuration
+// directory.
+func WithPluginConfDirs(dirs []string) Opt {
+	return func(c *libcni) error {
+		if len(dirs) == 0 {
+			return fmt.Errorf("no cni config directories: %w", ErrInvalidConfig)
+		}
+		c.pluginConfDir = dirs[len(dirs)-1]
+		c.pluginConfDirs = dirs
 		return nil
 	}
 }
@@ -83,23 +205,211 @@ func WithMinNetworkCount(count int) Opt {
 	}
 }
 
+// WithIdempotentSetup can be used to make Setup reuse the existing
+// attachments of the namespace. A network with a cached result for the
+// container ID and interface name is verified with CHECK and its cached
+// result returned, ADD is only run for networks not attached yet.
+func WithIdempotentSetup(c *libcni) error {
+	c.idempotentSetup = true
+	return nil
+}
+
+// WithCleanupTimeout can be used to configure the time
+// allowed to remove the networks of a Setup whose context
+// was cancelled. By default its DefaultCleanupTimeout.
+func WithCleanupTimeout(timeout time.Duration) Opt {
+	return func(c *libcni) error {
+		c.cleanupTimeout = timeout
+		return nil
+	}
+}
+
+// WithLenientLoad can be used to skip the network config
+// files of the config directory that fail to parse, have no
+// plugin type or have no plugins, instead of failing the load.
+// The skipped files are reported as warnings by GetConfig.
+func WithLenientLoad(c *libcni) error {
+	c.lenientLoad = true
+	return nil
+}
+
+// WithDefaultNetwork can be used to select the network called
+// name as the default network when loading the config directory,
+// instead of the first network in the sorted list of files.
+func WithDefaultNetwork(name string) Opt {
+	return func(c *libcni) error {
+		c.defaultNetwork = name
+		return nil
+	}
+}
+
+// WithDefaultNetworkMarker can be used to select the network whose
+// config list sets DefaultNetworkKey to true as the default network
+// when loading the config directory. If no network is marked the
+// first network in the sorted list of files is the default.
+func WithDefaultNetworkMarker(c *libcni) error {
+	c.defaultNetworkMarker = true
+	return nil
+}
+
+// WithNetworkPriority can be used to order the networks loaded from
+// the config directory. The networks named in names come first, in
+// that order, followed by the others in the sorted order of files.
+func WithNetworkPriority(names []string) Opt {
+	return func(c *libcni) error {
+		c.networkPriority = names
+		return nil
+	}
+}
+
+// WithConfFileFilter can be used to only load the files of the
+// config directory whose name matches one of the include patterns,
+// if any, and none of the exclude patterns. The patterns use the
+// path.Match syntax, e.g. "multus-*".
+func WithConfFileFilter(include, exclude []string) Opt {
+	return func(c *libcni) error {
+		f, err := newNameFilter(include, exclude)
+		if err != nil {
+			return err
+		}
+		c.confFileFilter = f
+		return nil
+	}
+}
+
+// WithNetworkNameFilter can be used to only load the networks of
+// the config directory whose name matches one of the include
+// patterns, if any, and none of the exclude patterns. The patterns
+// use the path.Match syntax.
+func WithNetworkNameFilter(include, exclude []string) Opt {
+	return func(c *libcni) error {
+		f, err := newNameFilter(include, exclude)
+		if err != nil {
+			return err
+		}
+		c.networkNameFilter = f
+		return nil
+	}
+}
+
+// WithDeduplicateNetworks can be used to drop the networks whose
+// name or interface name duplicates the one of a network loaded
+// before them, instead of failing the load. The dropped networks
+// are reported as warnings by GetConfig.
+func WithDeduplicateNetworks(c *libcni) error {
+	c.deduplicateNetworks = true
+	return nil
+}
+
+// WithConfVariables can be used to expand the ${NAME} variable
+// references of the network configs loaded from bytes or files
+// with vars, e.g. to set the pod CIDR of the node. A reference to
+// an undefined variable fails the load. The values are escaped as
+// JSON string contents, so they can not change the structure of the
+// configs. $${ can be used to write a literal ${.
+func WithConfVariables(vars map[string]string) Opt {
+	return func(c *libcni) error {
+		c.confVars = vars
+		return nil
+	}
+}
+
+// WithConfEnvVariables can be used to expand the variable references
+// of the network configs with the environment of the process, for
+// the variables not set by WithConfVariables.
+func WithConfEnvVariables(c *libcni) error {
+	c.confEnvVars = true
+	return nil
+}
+
 // WithLoNetwork can be used to load the loopback
-// network config.
+// network config. Its CNI version is the highest one supported
+// by both the installed loopback plugin and libcni, or 0.3.1 if
+// the loopback plugin can not be queried.
 func WithLoNetwork(c *libcni) error {
-	loConfig, _ := cnilibrary.ConfListFromBytes([]byte(`{
-"cniVersion": "0.3.1",
+	return WithLoNetworkConfig([]byte(fmt.Sprintf(`{
+"cniVersion": %q,
 "name": "cni-loopback",
 "plugins": [{
   "type": "loopback"
 }]
-}`))
+}`, c.loCNIVersion())))(c)
+}
 
-	c.networks = append(c.networks, &Network{
-		cni:    c.cniConfig,
-		config: loConfig,
-		ifName: "lo",
-	})
-	return nil
+// WithLoNetworkConfig can be used to load the network config list
+// bytes as the loopback network, attached to the lo interface.
+func WithLoNetworkConfig(bytes []byte) Opt {
+	return func(c *libcni) error {
+		loConfig, err := cnilibrary.ConfListFromBytes(bytes)
+		if err != nil {
+			return fmt.Errorf("invalid loopback network config: %v: %w", err, ErrInvalidConfig)
+		}
+		if len(loConfig.Plugins) == 0 {
+			return fmt.Errorf("loopback network config has no plugins: %w", ErrInvalidConfig)
+		}
+		c.networks = append(c.networks, &Network{
+			cni:    c.cniConfig,
+			config: loConfig,
+			ifName: loopbackIfName,
+		})
+		return nil
+	}
+}
+
+// cachedLoCNIVersion is the CNI version of the default loopback network
+// config for a version of the loopback plugin binary.
+type cachedLoCNIVersion struct {
+	modTime time.Time
+	size    int64
+	version string
+}
+
+// loCNIVersion returns the CNI version of the default loopback
+// network config. The loopback plugin is only asked once per binary.
+func (c *libcni) loCNIVersion() string {
+	cniConfig, ok := c.cniConfig.(*cnilibrary.CNIConfig)
+	if !ok {
+		return c.probeLoCNIVersion()
+	}
+	path, err := invoke.FindInPath("loopback", cniConfig.Path)
+	if err != nil {
+		return defaultLoCNIVersion
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return defaultLoCNIVersion
+	}
+	if v, ok := c.loCNIVersions[path]; ok && v.modTime.Equal(fi.ModTime()) && v.size == fi.Size() {
+		return v.version
+	}
+	v := c.probeLoCNIVersion()
+	if c.loCNIVersions == nil {
+		c.loCNIVersions = make(map[string]cachedLoCNIVersion)
+	}
+	c.loCNIVersions[path] = cachedLoCNIVersion{modTime: fi.ModTime(), size: fi.Size(), version: v}
+	return v
+}
+
+// probeLoCNIVersion returns the greatest CNI version supported by both
+// the loopback plugin and libcni.
+func (c *libcni) probeLoCNIVersion() string {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginProbeTimeout)
+	defer cancel()
+	info, err := c.cniConfig.GetVersionInfo(ctx, "loopback")
+	if err != nil {
+		return defaultLoCNIVersion
+	}
+	highest := defaultLoCNIVersion
+	for _, v := range info.SupportedVersions() {
+		if gt, err := version.GreaterThan(v, highest); err != nil || !gt {
+			continue
+		}
+		if gt, _ := version.GreaterThan(v, version.Current()); gt {
+			continue
+		}
+		highest = v
+	}
+	return highest
 }
 
 // WithConf can be used to load config directly
@@ -112,18 +422,22 @@ func WithConf(bytes []byte) Opt {
 // from byte and set the interface name's index.
 func WithConfIndex(bytes []byte, index int) Opt {
 	return func(c *libcni) error {
-		conf, err := cnilibrary.ConfFromBytes(bytes)
+		bytes, err := c.expandConf(bytes)
 		if err != nil {
 			return err
 		}
-		confList, err := cnilibrary.ConfListFromConf(conf)
+		conf, err := confFromBytes(bytes)
+		if err != nil {
+			return err
+		}
+		confList, err := confListFromConf(conf)
 		if err != nil {
 			return err
 		}
 		c.networks = append(c.networks, &Network{
 			cni:    c.cniConfig,
 			config: confList,
-			ifName: getIfName(c.prefix, index),
+			ifName: c.ifName(index, confList),
 		})
 		return nil
 	}
@@ -134,19 +448,19 @@ func WithConfIndex(bytes []byte, index int) Opt {
 // with path only.
 func WithConfFile(fileName string) Opt {
 	return func(c *libcni) error {
-		conf, err := cnilibrary.ConfFromFile(fileName)
+		conf, err := (&dirLoader{expand: c.confExpander()}).conf(fileName)
 		if err != nil {
 			return err
 		}
 		// upconvert to conf list
-		confList, err := cnilibrary.ConfListFromConf(conf)
+		confList, err := confListFromConf(conf)
 		if err != nil {
 			return err
 		}
 		c.networks = append(c.networks, &Network{
 			cni:    c.cniConfig,
 			config: confList,
-			ifName: getIfName(c.prefix, 0),
+			ifName: c.ifName(0, confList),
 		})
 		return nil
 	}
@@ -156,6 +470,10 @@ func WithConfFile(fileName string) Opt {
 // from byte
 func WithConfListBytes(bytes []byte) Opt {
 	return func(c *libcni) error {
+		bytes, err := c.expandConf(bytes)
+		if err != nil {
+			return err
+		}
 		confList, err := cnilibrary.ConfListFromBytes(bytes)
 		if err != nil {
 			return err
@@ -164,7 +482,7 @@ func WithConfListBytes(bytes []byte) Opt {
 		c.networks = append(c.networks, &Network{
 			cni:    c.cniConfig,
 			config: confList,
-			ifName: getIfName(c.prefix, i),
+			ifName: c.ifName(i, confList),
 		})
 		return nil
 	}
@@ -175,7 +493,7 @@ func WithConfListBytes(bytes []byte) Opt {
 // with path only.
 func WithConfListFile(fileName string) Opt {
 	return func(c *libcni) error {
-		confList, err := cnilibrary.ConfListFromFile(fileName)
+		confList, err := (&dirLoader{expand: c.confExpander()}).confList(fileName)
 		if err != nil {
 			return err
 		}
@@ -183,12 +501,42 @@ func WithConfListFile(fileName string) Opt {
 		c.networks = append(c.networks, &Network{
 			cni:    c.cniConfig,
 			config: confList,
-			ifName: getIfName(c.prefix, i),
+			ifName: c.ifName(i, confList),
 		})
 		return nil
 	}
 }
 
+// WithConfListReader can be used to load network config list
+// from a reader.
+func WithConfListReader(r io.Reader) Opt {
+	return func(c *libcni) error {
+		bytes, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("failed to read config list: %v: %w", err, ErrRead)
+		}
+		return WithConfListBytes(bytes)(c)
+	}
+}
+
+// WithConfFS can be used to detect the default network config
+// file from the directory dir of fsys and load it, following the
+// same rules as WithDefaultConf.
+func WithConfFS(fsys fs.FS, dir string) Opt {
+	return func(c *libcni) error {
+		return loadConfFiles(c, &fsLoader{fsys: fsys, dir: dir, expand: c.confExpander()}, c.pluginMaxConfNum)
+	}
+}
+
+// WithAllConfFS can be used to detect all network config files
+// from the directory dir of fsys and load them, following the
+// same rules as WithAllConf.
+func WithAllConfFS(fsys fs.FS, dir string) Opt {
+	return func(c *libcni) error {
+		return loadConfFiles(c, &fsLoader{fsys: fsys, dir: dir, expand: c.confExpander()}, 0)
+	}
+}
+
 // WithDefaultConf can be used to detect the default network
 // config file from the configured cni config directory and load
 // it.
@@ -207,66 +555,118 @@ func WithAllConf(c *libcni) error {
 }
 
 // loadFromConfDir detects network config files from the
-// configured cni config directory and load them. max is
+// configured cni config directories and load them. max is
 // the maximum network config to load (max i<= 0 means no limit).
 func loadFromConfDir(c *libcni, maxConfigs int) error {
-	files, err := cnilibrary.ConfFiles(c.pluginConfDir, []string{".conf", ".conflist", ".json"})
+	return loadConfFiles(c, &dirLoader{dirs: c.confDirs(), expand: c.confExpander()}, maxConfigs)
+}
+
+// loadConfFiles loads the network config files found by loader. max is
+// the maximum network config to load (max i<= 0 means no limit).
+func loadConfFiles(c *libcni, loader confLoader, maxConfigs int) error {
+	files, err := loader.confFiles()
 	switch {
 	case err != nil:
 		return fmt.Errorf("failed to read config file: %v: %w", err, ErrRead)
 	case len(files) == 0:
-		return fmt.Errorf("no network config found in %s: %w", c.pluginConfDir, ErrCNINotInitialized)
+		return fmt.Errorf("no network config found in %s: %w", loader, ErrCNINotInitialized)
 	}
 
-	// files contains the network config files associated with cni network.
-	// Use lexicographical way as a defined order for network config files.
-	sort.Strings(files)
 	// Since the CNI spec does not specify a way to detect default networks,
 	// the convention chosen is - the first network configuration in the sorted
 	// list of network conf files as the default network and choose the default
 	// interface provided during init as the network interface for this default
 	// network. For every other network use a generated interface id.
-	i := 0
+	// The default network and the order can be selected explicitly instead,
+	// in which case every file has to be parsed before any is chosen.
+	ordered := c.defaultNetwork != "" || c.defaultNetworkMarker || len(c.networkPriority) > 0
 	var networks []*Network
 	for _, confFile := range files {
-		var confList *cnilibrary.NetworkConfigList
-		if strings.HasSuffix(confFile, ".conflist") {
-			confList, err = cnilibrary.ConfListFromFile(confFile)
-			if err != nil {
-				return fmt.Errorf("failed to load CNI config list file %s: %v: %w", confFile, err, ErrInvalidConfig)
-			}
-		} else {
-			conf, err := cnilibrary.ConfFromFile(confFile)
-			if err != nil {
-				return fmt.Errorf("failed to load CNI config file %s: %v: %w", confFile, err, ErrInvalidConfig)
-			}
-			// Ensure the config has a "type" so we know what plugin to run.
-			// Also catches the case where somebody put a conflist into a conf file.
-			if conf.Network.Type == "" {
-				return fmt.Errorf("network type not found in %s: %w", confFile, ErrInvalidConfig)
-			}
-			confList, err = cnilibrary.ConfListFromConf(conf)
-			if err != nil {
-				return fmt.Errorf("failed to convert CNI config file %s to CNI config list: %v: %w", confFile, err, ErrInvalidConfig)
+		if !c.confFileFilter.match(path.Base(filepath.ToSlash(confFile))) {
+			continue
+		}
+		confList, err := parseConfFile(loader, confFile)
+		if err != nil {
+			if c.lenientLoad {
+				c.warnings = append(c.warnings, &ConfWarning{File: confFile, Reason: err.Error()})
+				continue
 			}
+			return err
 		}
-		if len(confList.Plugins) == 0 {
-			return fmt.Errorf("CNI config list in config file %s has no networks, skipping: %w", confFile, ErrInvalidConfig)
-
+		if !c.networkNameFilter.match(confList.Name) {
+			continue
 		}
 		networks = append(networks, &Network{
-			cni:    c.cniConfig,
-			config: confList,
-			ifName: getIfName(c.prefix, i),
+			cni:      c.cniConfig,
+			config:   confList,
+			confFile: confFile,
 		})
-		i++
-		if i == maxConfigs {
+		if !ordered && len(networks) == maxConfigs {
 			break
 		}
 	}
 	if len(networks) == 0 {
-		return fmt.Errorf("no valid networks found in %s: %w", c.pluginDirs, ErrCNINotInitialized)
+		return fmt.Errorf("no valid networks found in %s: %w", loader, ErrCNINotInitialized)
+	}
+	if ordered {
+		if networks, err = c.orderNetworks(networks); err != nil {
+			return err
+		}
+		if maxConfigs > 0 && len(networks) > maxConfigs {
+			networks = networks[:maxConfigs]
+		}
+	}
+	for i, network := range networks {
+		network.ifName = c.ifName(i, network.config)
 	}
 	c.networks = append(c.networks, networks...)
 	return nil
 }
+
+// parseConfFile parses a network config file found by loader,
+// upconverting a .conf or .json file to a config list.
+func parseConfFile(loader confLoader, confFile string) (*cnilibrary.NetworkConfigList, error) {
+	var confList *cnilibrary.NetworkConfigList
+	if strings.HasSuffix(confFile, ".conflist") {
+		var err error
+		confList, err = loader.confList(confFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CNI config list file %s: %v: %w", confFile, err, ErrInvalidConfig)
+		}
+	} else {
+		conf, err := loader.conf(confFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CNI config file %s: %v: %w", confFile, err, ErrInvalidConfig)
+		}
+		// Ensure the config has a "type" so we know what plugin to run.
+		// Also catches the case where somebody put a conflist into a conf file.
+		if conf.Network.Type == "" {
+			return nil, fmt.Errorf("network type not found in %s: %w", confFile, ErrInvalidConfig)
+		}
+		confList, err = confListFromConf(conf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert CNI config file %s to CNI config list: %v: %w", confFile, err, ErrInvalidConfig)
+		}
+	}
+	if len(confList.Plugins) == 0 {
+		return nil, fmt.Errorf("CNI config list in config file %s has no networks, skipping: %w", confFile, ErrInvalidConfig)
+	}
+	return confList, nil
+}
+
+// confFromFile parses a single network config file. The deprecated
+// cnilibrary parsers of single network configs are only called from
+// this file.
+func confFromFile(file string) (*cnilibrary.NetworkConfig, error) {
+	return cnilibrary.ConfFromFile(file)
+}
+
+// confFromBytes parses a single network config.
+func confFromBytes(bytes []byte) (*cnilibrary.NetworkConfig, error) {
+	return cnilibrary.ConfFromBytes(bytes)
+}
+
+// confListFromConf upconverts a single network config to a config list.
+func confListFromConf(conf *cnilibrary.NetworkConfig) (*cnilibrary.NetworkConfigList, error) {
+	return cnilibrary.ConfListFromConf(conf)
+}
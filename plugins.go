@@ -0,0 +1,212 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	cnilibrary "github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/invoke"
+)
+
+// PluginInfo describes the binary of a plugin type used by the loaded
+// networks.
+type PluginInfo struct {
+	PluginResolution
+	Mode fs.FileMode
+	Size int64
+	// SHA256 is the hex encoded SHA-256 hash of the binary.
+	SHA256 string
+	// Versions are the CNI versions the plugin supports, as reported
+	// by VERSION.
+	Versions []string
+	// Err is a *PluginError if the binary can not be used.
+	Err error
+}
+
+// PluginError is the error of a plugin binary that can not be used.
+type PluginError struct {
+	Type string
+	// Path is empty if the binary was not found.
+	Path string
+	Err  error
+}
+
+func (e *PluginError) Error() string {
+	return fmt.Sprintf("plugin %s %v", e.Type, e.Err)
+}
+
+func (e *PluginError) Unwrap() error {
+	return e.Err
+}
+
+// PluginInventory returns the binaries of the plugin types used by the
+// loaded networks, with the CNI versions they support. The returned
+// error joins the errors of the binaries that can not be used.
+func (c *libcni) PluginInventory(ctx context.Context) ([]*PluginInfo, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.pluginInventory(ctx, true)
+}
+
+// pluginInventory returns the binaries of the plugin types used by the
+// loaded networks. Unless full is set the binaries are only looked up
+// and checked, neither hashed nor called.
+func (c *libcni) pluginInventory(ctx context.Context, full bool) ([]*PluginInfo, error) {
+	var (
+		plugins []*PluginInfo
+		errs    []error
+	)
+	for _, ref := range c.pluginRefs() {
+		p := &PluginInfo{PluginResolution: *ref.resolve()}
+		if err := p.inspect(ctx, ref.cni, full); err != nil {
+			p.Err = &PluginError{Type: p.Type, Path: p.Path, Err: err}
+			errs = append(errs, p.Err)
+		}
+		plugins = append(plugins, p)
+	}
+	return plugins, errors.Join(errs...)
+}
+
+// inspect fills in the details of the plugin binary.
+func (p *PluginInfo) inspect(ctx context.Context, cni cnilibrary.CNI, full bool) error {
+	if p.Path == "" {
+		return ErrNotFound
+	}
+	fi, err := os.Stat(p.Path)
+	if err != nil {
+		return err
+	}
+	p.Mode = fi.Mode()
+	p.Size = fi.Size()
+	// Windows has no executable bit.
+	if runtime.GOOS != "windows" && p.Mode.Perm()&0o111 == 0 {
+		return ErrNotExecutable
+	}
+	if !full {
+		return nil
+	}
+	if p.SHA256, err = fileSHA256(p.Path); err != nil {
+		return err
+	}
+	info, err := cni.GetVersionInfo(ctx, p.Type)
+	if err != nil {
+		return fmt.Errorf("failed VERSION: %w", err)
+	}
+	p.Versions = info.SupportedVersions()
+	return nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 hash of the file.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readerSHA256(f)
+}
+
+func readerSHA256(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// PluginResolution describes where the binary of a plugin type is found.
+type PluginResolution struct {
+	Type string
+	// Path is the path of the binary, empty if it is not in any of the
+	// plugin directories.
+	Path string
+	// Dir is the plugin directory the binary was found in.
+	Dir string
+	// Dirs are the plugin directories searched.
+	Dirs []string
+}
+
+// pluginRef is a plugin type used by the loaded networks sharing the
+// same plugin directories.
+type pluginRef struct {
+	pluginType string
+	dirs       []string
+	cni        cnilibrary.CNI
+}
+
+// pluginRefs returns the plugin types, IPAM included, used by the
+// loaded networks, sorted by type.
+func (c *libcni) pluginRefs() []*pluginRef {
+	seen := make(map[string]bool)
+	var refs []*pluginRef
+	for _, network := range c.networks {
+		dirs := c.networkPluginDirs(network)
+		for _, plugin := range network.config.Plugins {
+			for _, t := range []string{plugin.Network.Type, plugin.Network.IPAM.Type} {
+				key := strings.Join(append([]string{t}, dirs...), "\x00")
+				if t == "" || seen[key] {
+					continue
+				}
+				seen[key] = true
+				refs = append(refs, &pluginRef{pluginType: t, dirs: dirs, cni: network.cni})
+			}
+		}
+	}
+	sort.SliceStable(refs, func(i, j int) bool {
+		return refs[i].pluginType < refs[j].pluginType
+	})
+	return refs
+}
+
+// resolvePlugins returns where the plugin types of the loaded networks
+// are found, the first plugin directory having the binary winning.
+func (c *libcni) resolvePlugins() []*PluginResolution {
+	var resolutions []*PluginResolution
+	for _, ref := range c.pluginRefs() {
+		resolutions = append(resolutions, ref.resolve())
+	}
+	return resolutions
+}
+
+func (r *pluginRef) resolve() *PluginResolution {
+	resolution := &PluginResolution{Type: r.pluginType, Dirs: r.dirs}
+	if path, err := invoke.FindInPath(r.pluginType, r.dirs); err == nil {
+		resolution.Path = path
+		resolution.Dir = filepath.Dir(path)
+	}
+	return resolution
+}
+
+// networkPluginDirs returns the plugin directories of the network.
+func (c *libcni) networkPluginDirs(network *Network) []string {
+	if network.pluginDirs != nil {
+		return network.pluginDirs
+	}
+	return c.pluginDirs
+}
@@ -0,0 +1,93 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPluginInventory(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("plugin binaries have no executable bit on windows")
+	}
+
+	pluginDir := t.TempDir()
+	binary := []byte("#!/bin/sh\n")
+	assert.NoError(t, os.WriteFile(filepath.Join(pluginDir, "bridge"), binary, 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(pluginDir, "portmap"), binary, 0o644))
+
+	c, err := New(
+		WithPluginDir([]string{pluginDir}),
+		WithPluginCheck,
+		WithConfListBytes([]byte(`{
+			"cniVersion": "1.0.0",
+			"name": "net",
+			"plugins": [{"type": "bridge"}, {"type": "portmap"}, {"type": "tuning"}]
+		}`)),
+	)
+	assert.NoError(t, err)
+	l := c.(*libcni)
+	mockCNI := &MockCNI{}
+	l.cniConfig = mockCNI
+	l.networks[0].cni = mockCNI
+	mockCNI.On("GetVersionInfo", "bridge").Return(version.PluginSupports("0.4.0", "1.0.0"), nil)
+
+	plugins, err := l.PluginInventory(context.Background())
+	assert.Len(t, plugins, 3)
+	mockCNI.AssertExpectations(t)
+
+	sum := sha256.Sum256(binary)
+	bridge := plugins[0]
+	assert.Equal(t, "bridge", bridge.Type)
+	assert.Equal(t, filepath.Join(pluginDir, "bridge"), bridge.Path)
+	assert.Equal(t, os.FileMode(0o755), bridge.Mode.Perm())
+	assert.Equal(t, int64(len(binary)), bridge.Size)
+	assert.Equal(t, hex.EncodeToString(sum[:]), bridge.SHA256)
+	assert.Equal(t, []string{"0.4.0", "1.0.0"}, bridge.Versions)
+	assert.NoError(t, bridge.Err)
+
+	portmap := plugins[1]
+	assert.Equal(t, filepath.Join(pluginDir, "portmap"), portmap.Path)
+	assert.ErrorIs(t, portmap.Err, ErrNotExecutable)
+	assert.Empty(t, portmap.SHA256)
+
+	tuning := plugins[2]
+	assert.Empty(t, tuning.Path)
+	assert.ErrorIs(t, tuning.Err, ErrNotFound)
+	assert.EqualError(t, tuning.Err, "plugin tuning not found")
+
+	assert.ErrorIs(t, err, ErrNotExecutable)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	err = l.Status()
+	var pluginErr *PluginError
+	if assert.True(t, errors.As(err, &pluginErr)) {
+		assert.Equal(t, "portmap", pluginErr.Type)
+	}
+	assert.ErrorContains(t, err, "plugin tuning not found")
+}
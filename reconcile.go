@@ -0,0 +1,144 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	cnilibrary "github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// LiveSandboxesFunc returns the IDs of the sandboxes that are still alive.
+type LiveSandboxesFunc func(ctx context.Context) ([]string, error)
+
+// ReconcileReport describes what a reconciliation cleaned up.
+type ReconcileReport struct {
+	// Removed are the orphaned attachments that were deleted.
+	Removed []*Attachment
+	// Failed are the orphaned attachments that could not be deleted.
+	Failed []*Attachment
+	// GCNetworks are the names of the networks garbage collected.
+	GCNetworks []string
+}
+
+// Reconcile deletes the cached attachments whose container is not
+// returned by liveSandboxes or whose network namespace no longer exists,
+// then runs GC for the loaded networks supporting CNI version 1.1.0 or
+// greater. liveSandboxes is called once the cached attachments are
+// listed, so that a sandbox attached in between is never seen as an
+// orphan. Deletion is best effort: every orphan is attempted and the
+// errors are joined.
+func (c *libcni) Reconcile(ctx context.Context, liveSandboxes LiveSandboxesFunc) (*ReconcileReport, error) {
+	c.RLock()
+	defer c.RUnlock()
+	attachments, err := c.attachments("")
+	if err != nil {
+		return nil, err
+	}
+	liveIDs, err := liveSandboxes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list live sandboxes: %w", err)
+	}
+	live := make(map[string]bool, len(liveIDs))
+	for _, id := range liveIDs {
+		live[id] = true
+	}
+
+	var (
+		errs  []error
+		valid []types.GCAttachment
+		r     = &ReconcileReport{}
+	)
+	for _, a := range attachments {
+		netnsGone := a.NetNS != "" && !pathExists(a.NetNS)
+		if live[a.ContainerID] && !netnsGone {
+			valid = append(valid, types.GCAttachment{
+				ContainerID: a.ContainerID,
+				IfName:      a.IfName,
+			})
+			continue
+		}
+		if err := c.removeAttachment(ctx, a); err != nil {
+			r.Failed = append(r.Failed, a)
+			errs = append(errs, err)
+			continue
+		}
+		r.Removed = append(r.Removed, a)
+	}
+
+	// GC is only called for CNI Version 1.1.0 or greater.
+	for _, network := range c.networks {
+		if gt, _ := version.GreaterThanOrEqualTo(network.config.CNIVersion, "1.1.0"); !gt {
+			continue
+		}
+		if err := network.cni.GCNetworkList(ctx, network.config, &cnilibrary.GCArgs{ValidAttachments: valid}); err != nil {
+			errs = append(errs, fmt.Errorf("failed to gc network %s: %w", network.config.Name, err))
+			continue
+		}
+		r.GCNetworks = append(r.GCNetworks, network.config.Name)
+	}
+	return r, errors.Join(errs...)
+}
+
+// Reconciler periodically reconciles the cni attachments against the
+// live sandboxes.
+type Reconciler struct {
+	cni      SandboxReconciler
+	live     LiveSandboxesFunc
+	interval time.Duration
+	report   func(*ReconcileReport, error)
+}
+
+// NewReconciler creates a Reconciler running every interval. report, if
+// not nil, is called with the outcome of every reconciliation.
+func NewReconciler(cni SandboxReconciler, live LiveSandboxesFunc, interval time.Duration, report func(*ReconcileReport, error)) (*Reconciler, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid reconcile interval %v: %w", interval, ErrInvalidConfig)
+	}
+	return &Reconciler{
+		cni:      cni,
+		live:     live,
+		interval: interval,
+		report:   report,
+	}, nil
+}
+
+// Run reconciles once, then on every tick until ctx is done.
+func (r *Reconciler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		report, err := r.reconcile(ctx)
+		if r.report != nil {
+			r.report(report, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reconciler) reconcile(ctx context.Context) (*ReconcileReport, error) {
+	return r.cni.Reconcile(ctx, r.live)
+}
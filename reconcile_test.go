@@ -0,0 +1,150 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	cnilibrary "github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestReconcile(t *testing.T) {
+	t.Parallel()
+
+	l := defaultCNIConfig()
+	_, confDir := buildFakeConfig(t)
+	l.pluginConfDir = confDir
+	err := l.Load(WithDefaultConf)
+	assert.NoError(t, err)
+
+	mockCNI := &MockCNI{}
+	l.cniConfig = mockCNI
+	l.networks[0].cni = mockCNI
+
+	liveNetNS := t.TempDir()
+	deadNetNS := path.Join(t.TempDir(), "gone")
+	conf := l.networks[0].config.Bytes
+	mockCNI.On("GetCachedAttachments", "").Return([]*cnilibrary.NetworkAttachment{
+		{ContainerID: "live", Network: "containerd-net", IfName: "eth0", NetNS: liveNetNS, Config: conf},
+		{ContainerID: "dead", Network: "containerd-net", IfName: "eth0", NetNS: liveNetNS, Config: conf},
+		{ContainerID: "live", Network: "containerd-net", IfName: "eth1", NetNS: deadNetNS, Config: conf},
+	}, nil)
+	mockCNI.On("GetNetworkListCachedResult", mock.Anything, mock.Anything).Return(&types100.Result{CNIVersion: "1.1.0"}, nil)
+	mockCNI.On("DelNetworkList", mock.Anything, &cnilibrary.RuntimeConf{
+		ContainerID: "dead",
+		NetNS:       liveNetNS,
+		IfName:      "eth0",
+	}).Return(nil)
+	mockCNI.On("DelNetworkList", mock.Anything, &cnilibrary.RuntimeConf{
+		ContainerID: "live",
+		IfName:      "eth1",
+	}).Return(nil)
+	mockCNI.On("GCNetworkList", l.networks[0].config, &cnilibrary.GCArgs{
+		ValidAttachments: []types.GCAttachment{{ContainerID: "live", IfName: "eth0"}},
+	}).Return(nil)
+
+	r, err := l.Reconcile(context.Background(), func(context.Context) ([]string, error) {
+		return []string{"live"}, nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, r.Removed, 2)
+	assert.Equal(t, "dead", r.Removed[0].ContainerID)
+	assert.Equal(t, "eth1", r.Removed[1].IfName)
+	assert.Empty(t, r.Failed)
+	assert.Equal(t, []string{"containerd-net"}, r.GCNetworks)
+	mockCNI.AssertExpectations(t)
+}
+
+func TestReconcileListsAttachmentsFirst(t *testing.T) {
+	t.Parallel()
+
+	l := defaultCNIConfig()
+	_, confDir := buildFakeConfig(t)
+	l.pluginConfDir = confDir
+	err := l.Load(WithDefaultConf)
+	assert.NoError(t, err)
+
+	mockCNI := &MockCNI{}
+	l.cniConfig = mockCNI
+	l.networks[0].cni = mockCNI
+
+	netns := t.TempDir()
+	mockCNI.On("GetCachedAttachments", "").Return([]*cnilibrary.NetworkAttachment{
+		{ContainerID: "new", Network: "containerd-net", IfName: "eth0", NetNS: netns, Config: l.networks[0].config.Bytes},
+	}, nil)
+	mockCNI.On("GetNetworkListCachedResult", mock.Anything, mock.Anything).Return(&types100.Result{CNIVersion: "1.1.0"}, nil)
+	mockCNI.On("GCNetworkList", l.networks[0].config, &cnilibrary.GCArgs{
+		ValidAttachments: []types.GCAttachment{{ContainerID: "new", IfName: "eth0"}},
+	}).Return(nil)
+
+	// The sandbox "new" was attached after the attachments were listed,
+	// so only the second listing of live sandboxes knows about it.
+	r, err := l.Reconcile(context.Background(), func(context.Context) ([]string, error) {
+		mockCNI.AssertNumberOfCalls(t, "GetCachedAttachments", 1)
+		return []string{"new"}, nil
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, r.Removed)
+	mockCNI.AssertNotCalled(t, "DelNetworkList", mock.Anything, mock.Anything)
+	mockCNI.AssertExpectations(t)
+}
+
+type fakeReconciler struct {
+	liveIDs [][]string
+}
+
+func (f *fakeReconciler) Reconcile(ctx context.Context, liveSandboxes LiveSandboxesFunc) (*ReconcileReport, error) {
+	liveIDs, err := liveSandboxes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f.liveIDs = append(f.liveIDs, liveIDs)
+	return &ReconcileReport{}, nil
+}
+
+func TestReconcilerRun(t *testing.T) {
+	t.Parallel()
+
+	live := func(context.Context) ([]string, error) {
+		return []string{"live"}, nil
+	}
+	_, err := NewReconciler(&fakeReconciler{}, live, 0, nil)
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := &fakeReconciler{}
+	reports := 0
+	r, err := NewReconciler(f, live, time.Millisecond, func(report *ReconcileReport, err error) {
+		assert.NotNil(t, report)
+		assert.NoError(t, err)
+		if reports++; reports == 3 {
+			cancel()
+		}
+	})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, r.Run(ctx), context.Canceled)
+	assert.Equal(t, 3, reports)
+	assert.Equal(t, [][]string{{"live"}, {"live"}, {"live"}}, f.liveIDs)
+}
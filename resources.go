@@ -0,0 +1,180 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// PluginResources limits the resources of the plugin processes. It is
+// only supported on Linux. The rlimits and niceness are set on the
+// plugin process once it is started, and before its config is written
+// to its stdin, so the plugin may briefly run without them while it
+// initializes. The same goes for the cgroup on kernels older than 5.7,
+// which cannot start a process in a cgroup.
+type PluginResources struct {
+	// Rlimits are set on the plugin processes.
+	Rlimits []PluginRlimit
+	// Nice is the niceness of the plugin processes. Zero leaves the
+	// niceness unchanged.
+	Nice int
+	// CgroupDir is a cgroup v2 directory the plugin processes are
+	// started in, e.g. /sys/fs/cgroup/cni-plugins.
+	CgroupDir string
+}
+
+// PluginRlimit is a resource limit of the plugin processes.
+type PluginRlimit struct {
+	// Resource is the RLIMIT_* resource, e.g. syscall.RLIMIT_AS.
+	Resource int
+	Soft     uint64
+	Hard     uint64
+}
+
+// PluginUsage is the resource usage of a plugin invocation.
+type PluginUsage struct {
+	Type        string
+	Path        string
+	Command     string
+	ContainerID string
+	Duration    time.Duration
+	UserTime    time.Duration
+	SystemTime  time.Duration
+	// MaxRSS is the maximum resident set size in bytes, zero where it
+	// is not available.
+	MaxRSS int64
+	// Err is the error of the invocation, if any.
+	Err error
+}
+
+// WithPluginResources can be used to limit the resources of the
+// plugin processes run by the default executor.
+func WithPluginResources(resources PluginResources) Opt {
+	return func(c *libcni) error {
+		if err := validatePluginResources(&resources); err != nil {
+			return fmt.Errorf("invalid plugin resources: %v: %w", err, ErrInvalidConfig)
+		}
+		resources.Rlimits = append([]PluginRlimit{}, resources.Rlimits...)
+		c.pluginResources = &resources
+		return nil
+	}
+}
+
+// WithPluginUsageFunc can be used to record the resource usage of
+// every plugin invocation of the default executor, e.g. to log it or
+// export it as metrics. fn is called concurrently by the operations
+// running plugins at the same time, e.g. Setup attaching the networks
+// in parallel, and must not block.
+func WithPluginUsageFunc(fn func(*PluginUsage)) Opt {
+	return func(c *libcni) error {
+		c.pluginUsageFunc = fn
+		return nil
+	}
+}
+
+// runPlugin runs the plugin like invoke.RawExec does, within the plugin
+// resources and recording its usage. If binary is not nil, it is the
+// opened plugin binary to run where possible.
+func (c *config) runPlugin(ctx context.Context, pluginPath string, binary *os.File, stdinData []byte, environ []string) ([]byte, error) {
+	var (
+		stdout, stderr bytes.Buffer
+		err            error
+	)
+	for i := 0; i <= 5; i++ {
+		stdout.Reset()
+		stderr.Reset()
+		cmd := exec.CommandContext(ctx, pluginPath)
+		cmd.Env = environ
+		cmd.Stdin = bytes.NewReader(stdinData)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if binary != nil {
+			execBinary(cmd, binary)
+		}
+
+		start := time.Now()
+		err = startPlugin(cmd, c.pluginResources)
+		if err == nil {
+			err = cmd.Wait()
+		}
+		if cmd.ProcessState != nil && c.pluginUsageFunc != nil {
+			c.pluginUsageFunc(newPluginUsage(pluginPath, cmd, time.Since(start), environ, err))
+		}
+		if err == nil {
+			break
+		}
+		// If the plugin is currently about to be written, then wait a
+		// second and try it again.
+		if strings.Contains(err.Error(), "text file busy") {
+			time.Sleep(time.Second)
+			continue
+		}
+		return nil, pluginErr(err, stdout.Bytes(), stderr.Bytes())
+	}
+	if err != nil {
+		return nil, pluginErr(err, stdout.Bytes(), stderr.Bytes())
+	}
+	if stderr.Len() > 0 {
+		_, _ = stderr.WriteTo(os.Stderr)
+	}
+	return stdout.Bytes(), nil
+}
+
+func newPluginUsage(pluginPath string, cmd *exec.Cmd, duration time.Duration, environ []string, err error) *PluginUsage {
+	u := &PluginUsage{
+		Type:       pluginTypeFromPath(pluginPath),
+		Path:       pluginPath,
+		Duration:   duration,
+		UserTime:   cmd.ProcessState.UserTime(),
+		SystemTime: cmd.ProcessState.SystemTime(),
+		MaxRSS:     maxRSS(cmd.ProcessState),
+		Err:        err,
+	}
+	for _, kv := range environ {
+		switch name, value, _ := strings.Cut(kv, "="); name {
+		case "CNI_COMMAND":
+			u.Command = value
+		case "CNI_CONTAINERID":
+			u.ContainerID = value
+		}
+	}
+	return u
+}
+
+// pluginErr returns the error of a failed plugin, as invoke.RawExec does.
+func pluginErr(err error, stdout, stderr []byte) error {
+	emsg := types.Error{}
+	if len(stdout) == 0 {
+		if len(stderr) == 0 {
+			emsg.Msg = fmt.Sprintf("netplugin failed with no error message: %v", err)
+		} else {
+			emsg.Msg = fmt.Sprintf("netplugin failed: %q", string(stderr))
+		}
+	} else if perr := json.Unmarshal(stdout, &emsg); perr != nil {
+		emsg.Msg = fmt.Sprintf("netplugin failed but error parsing its diagnostic message %q: %v", string(stdout), perr)
+	}
+	return &emsg
+}
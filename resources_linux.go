@@ -0,0 +1,188 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+func validatePluginResources(r *PluginResources) error {
+	for _, rl := range r.Rlimits {
+		if rl.Resource < 0 {
+			return fmt.Errorf("invalid rlimit resource %d", rl.Resource)
+		}
+		if rl.Soft > rl.Hard {
+			return fmt.Errorf("soft limit of rlimit resource %d is greater than its hard limit", rl.Resource)
+		}
+	}
+	if r.Nice < -20 || r.Nice > 19 {
+		return fmt.Errorf("invalid niceness %d", r.Nice)
+	}
+	if r.CgroupDir != "" {
+		if !filepath.IsAbs(r.CgroupDir) {
+			return fmt.Errorf("cgroup directory %s is not absolute", r.CgroupDir)
+		}
+		if _, err := os.Stat(filepath.Join(r.CgroupDir, "cgroup.procs")); err != nil {
+			return fmt.Errorf("%s is not a cgroup v2 directory: %w", r.CgroupDir, err)
+		}
+	}
+	return nil
+}
+
+// startPlugin starts the plugin command within the resources. Where the
+// kernel supports it, the process is started in the cgroup, so that none
+// of its children escape it. The rlimits, the niceness and otherwise the
+// cgroup are set once the process is started, before its stdin is
+// written.
+func startPlugin(cmd *exec.Cmd, r *PluginResources) error {
+	if r == nil {
+		return cmd.Start()
+	}
+	var cgroupProcs string
+	if r.CgroupDir != "" {
+		if cloneIntoCgroup() {
+			cgroup, err := os.Open(r.CgroupDir)
+			if err != nil {
+				return fmt.Errorf("failed to open cgroup: %w", err)
+			}
+			defer cgroup.Close()
+			cmd.SysProcAttr = &syscall.SysProcAttr{
+				UseCgroupFD: true,
+				CgroupFD:    int(cgroup.Fd()),
+			}
+		} else {
+			cgroupProcs = filepath.Join(r.CgroupDir, "cgroup.procs")
+		}
+	}
+	open := make(chan struct{})
+	cmd.Stdin = &gatedReader{r: cmd.Stdin, open: open}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	err := limitPlugin(cmd.Process.Pid, r, cgroupProcs)
+	if err != nil {
+		// Never let the plugin read its config without its limits.
+		_ = cmd.Process.Kill()
+	}
+	close(open)
+	if err != nil {
+		_ = cmd.Wait()
+		return fmt.Errorf("failed to limit plugin resources: %w", err)
+	}
+	return nil
+}
+
+// limitPlugin moves the started plugin process pid to the cgroup whose
+// cgroup.procs file is cgroupProcs, if not empty, and sets its rlimits
+// and niceness.
+func limitPlugin(pid int, r *PluginResources, cgroupProcs string) error {
+	if cgroupProcs != "" {
+		if err := os.WriteFile(cgroupProcs, []byte(strconv.Itoa(pid)), 0o644); err != nil {
+			return fmt.Errorf("failed to move plugin to cgroup: %w", err)
+		}
+	}
+	for _, rl := range r.Rlimits {
+		if err := prlimit(pid, rl.Resource, rl.Soft, rl.Hard); err != nil {
+			return fmt.Errorf("failed to set rlimit resource %d: %w", rl.Resource, err)
+		}
+	}
+	if r.Nice != 0 {
+		if err := setNice(pid, r.Nice); err != nil {
+			return fmt.Errorf("failed to set niceness: %w", err)
+		}
+	}
+	return nil
+}
+
+// prlimit sets the rlimit resource of the process pid, with the
+// prlimit(2) the syscall package does not export.
+func prlimit(pid, resource int, soft, hard uint64) error {
+	limit := struct{ cur, max uint64 }{soft, hard}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setNice sets the niceness of every thread of the process pid, which
+// the threads it starts afterwards inherit.
+func setNice(pid, nice int) error {
+	tasks, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloneIntoCgroup reports whether the kernel supports starting a
+// process in a cgroup with CLONE_INTO_CGROUP, added in Linux 5.7.
+var cloneIntoCgroup = sync.OnceValue(func() bool {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return false
+	}
+	var release []byte
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(release), "%d.%d", &major, &minor); err != nil {
+		return false
+	}
+	return major > 5 || major == 5 && minor >= 7
+})
+
+// gatedReader blocks reading r until open is closed.
+type gatedReader struct {
+	r    io.Reader
+	open <-chan struct{}
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	<-g.open
+	return g.r.Read(p)
+}
+
+func maxRSS(state *os.ProcessState) int64 {
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// ru_maxrss is in kilobytes on Linux.
+		return int64(rusage.Maxrss) * 1024
+	}
+	return 0
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	cnilibrary "github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPluginResources(t *testing.T) {
+	t.Parallel()
+
+	// The plugin reports its limits, set before its config is written
+	// to its stdin, as its supported versions.
+	pluginDir := t.TempDir()
+	plugin := `#!/bin/sh
+cat >/dev/null
+if [ "$CNI_COMMAND" = "VERSION" ]; then
+	echo "{\"cniVersion\": \"1.0.0\", \"supportedVersions\": [\"$(ulimit -n)\", \"$(cut -d' ' -f19 /proc/self/stat)\"]}"
+	exit 0
+fi
+echo '{"cniVersion": "1.0.0", "code": 7, "msg": "unsupported"}'
+exit 1
+`
+	assert.NoError(t, os.WriteFile(filepath.Join(pluginDir, "limited"), []byte(plugin), 0o755))
+
+	var usages []*PluginUsage
+	c, err := New(
+		WithPluginDir([]string{pluginDir}),
+		WithCacheDir(t.TempDir()),
+		WithPluginResources(PluginResources{
+			Rlimits: []PluginRlimit{{Resource: syscall.RLIMIT_NOFILE, Soft: 64, Hard: 64}},
+			Nice:    5,
+		}),
+		WithPluginUsageFunc(func(u *PluginUsage) { usages = append(usages, u) }),
+	)
+	assert.NoError(t, err)
+	l := c.(*libcni)
+
+	info, err := l.cniConfig.GetVersionInfo(context.Background(), "limited")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"64", "5"}, info.SupportedVersions())
+
+	confList, err := cnilibrary.ConfListFromBytes([]byte(`{"cniVersion": "1.0.0", "name": "net", "plugins": [{"type": "limited"}]}`))
+	assert.NoError(t, err)
+	_, err = l.cniConfig.AddNetworkList(context.Background(), confList, &cnilibrary.RuntimeConf{
+		ContainerID: "container-id",
+		NetNS:       "/proc/self/ns/net",
+		IfName:      "eth0",
+	})
+	var pluginErr *types.Error
+	if assert.ErrorAs(t, err, &pluginErr) {
+		assert.Equal(t, uint(7), pluginErr.Code)
+	}
+
+	if assert.Len(t, usages, 2) {
+		assert.Equal(t, "limited", usages[0].Type)
+		assert.Equal(t, filepath.Join(pluginDir, "limited"), usages[0].Path)
+		assert.Equal(t, "VERSION", usages[0].Command)
+		assert.NoError(t, usages[0].Err)
+		assert.Positive(t, usages[0].MaxRSS)
+		assert.Equal(t, "ADD", usages[1].Command)
+		assert.Equal(t, "container-id", usages[1].ContainerID)
+		assert.Error(t, usages[1].Err)
+	}
+
+	// Without CLONE_INTO_CGROUP, the plugin is moved to its cgroup once
+	// started.
+	cgroupProcs := filepath.Join(t.TempDir(), "cgroup.procs")
+	assert.NoError(t, limitPlugin(os.Getpid(), &PluginResources{}, cgroupProcs))
+	procs, err := os.ReadFile(cgroupProcs)
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid()), string(procs))
+
+	_, err = New(WithPluginResources(PluginResources{Nice: 20}))
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+	_, err = New(WithPluginResources(PluginResources{CgroupDir: t.TempDir()}))
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+}
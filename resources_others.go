@@ -0,0 +1,41 @@
+//go:build !linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cni
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+func validatePluginResources(r *PluginResources) error {
+	if len(r.Rlimits) > 0 || r.Nice != 0 || r.CgroupDir != "" {
+		return fmt.Errorf("plugin resources are not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
+
+func startPlugin(cmd *exec.Cmd, _ *PluginResources) error {
+	return cmd.Start()
+}
+
+func maxRSS(*os.ProcessState) int64 {
+	return 0
+}
@@ -77,7 +77,7 @@ func (c *libcni) createResult(results []*types100.Result) (*Result, error) {
 	// Plugins may not need to return Interfaces in result if
 	// if there are no multiple interfaces created. In that case
 	// all configs should be applied against default interface
-	r.Interfaces[defaultInterface(c.prefix)] = &Config{}
+	r.Interfaces[c.defaultIfName] = &Config{}
 
 	// Walk through all the results
 	for _, result := range results {
@@ -103,8 +103,8 @@ func (c *libcni) createResult(results []*types100.Result) (*Result, error) {
 		r.DNS = append(r.DNS, result.DNS)
 		r.Routes = append(r.Routes, result.Routes...)
 	}
-	if _, ok := r.Interfaces[defaultInterface(c.prefix)]; !ok {
-		return nil, fmt.Errorf("default network not found for: %s: %w", defaultInterface(c.prefix), ErrNotFound)
+	if _, ok := r.Interfaces[c.defaultIfName]; !ok {
+		return nil, fmt.Errorf("default network not found for: %s: %w", c.defaultIfName, ErrNotFound)
 	}
 	return r, nil
 }
@@ -117,5 +117,5 @@ func (c *libcni) getInterfaceName(interfaces []*types100.Interface,
 	if ipConf.Interface != nil {
 		return interfaces[*ipConf.Interface].Name
 	}
-	return defaultInterface(c.prefix)
+	return c.defaultIfName
 }
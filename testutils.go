@@ -17,10 +17,16 @@
 package cni
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path"
 	"testing"
+
+	cnilibrary "github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/version"
 )
 
 func makeFakeCNIConfig(t *testing.T) (string, string) {
@@ -115,3 +121,62 @@ func buildFakeConfig(t *testing.T) (string, string) {
 
 	return cniDir, cniConfDir
 }
+
+// writeFakeCachedAttachment writes a libcni cache entry for an attachment
+// of a 1.0.0 network called netName with a single fakecni plugin.
+func writeFakeCachedAttachment(t *testing.T, cacheDir, netName, id, ifName, netns, cidr string) {
+	resultsDir := path.Join(cacheDir, "results")
+	if err := os.MkdirAll(resultsDir, 0700); err != nil {
+		t.Fatalf("Failed to create cache results dir: %v", err)
+	}
+	conf := fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "%s", "plugins": [{"type": "fakecni"}]}`, netName)
+	cached := map[string]interface{}{
+		"kind":        cnilibrary.CNICacheV1,
+		"containerId": id,
+		"config":      []byte(conf),
+		"ifName":      ifName,
+		"networkName": netName,
+		"netns":       netns,
+		"result": map[string]interface{}{
+			"cniVersion": "1.0.0",
+			"ips":        []map[string]interface{}{{"address": cidr}},
+		},
+	}
+	data, err := json.Marshal(cached)
+	if err != nil {
+		t.Fatalf("Failed to marshal cached attachment: %v", err)
+	}
+	name := path.Join(resultsDir, fmt.Sprintf("%s-%s-%s", netName, id, ifName))
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatalf("Failed to write cached attachment %s: %v", name, err)
+	}
+}
+
+// writeFakeConfFile writes a network config file called name in dir.
+func writeFakeConfFile(t *testing.T, dir, name, conf string) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatalf("Failed to create network config dir: %v", err)
+	}
+	if err := os.WriteFile(path.Join(dir, name), []byte(conf), 0644); err != nil {
+		t.Fatalf("Failed to write network config file %s: %v", name, err)
+	}
+}
+
+// fakeExec is an invoke.Exec recording the plugins it runs instead of
+// running them.
+type fakeExec struct {
+	version.PluginDecoder
+	output  []byte
+	calls   []string
+	environ []string
+}
+
+func (e *fakeExec) ExecPlugin(_ context.Context, pluginPath string, _ []byte, environ []string) ([]byte, error) {
+	e.calls = append(e.calls, pluginPath)
+	e.environ = environ
+	return e.output, nil
+}
+
+func (e *fakeExec) FindInPath(plugin string, paths []string) (string, error) {
+	return invoke.FindInPath(plugin, paths)
+}
@@ -16,17 +16,82 @@
 
 package cni
 
+import (
+	"time"
+
+	cnilibrary "github.com/containernetworking/cni/libcni"
+)
+
 const (
 	CNIPluginName     = "cni"
 	DefaultMaxConfNum = 1
 	DefaultPrefix     = "eth"
+	// DefaultCleanupTimeout is the time allowed to remove the networks
+	// of a Setup whose context was cancelled.
+	DefaultCleanupTimeout = 30 * time.Second
+	// DefaultNetworkKey is the config list key marking the default
+	// network, see WithDefaultNetworkMarker.
+	DefaultNetworkKey = "io.containerd.cni.default-network"
+	// MaxIfNameLen is the maximum length of an interface name,
+	// IFNAMSIZ minus the terminating null byte.
+	MaxIfNameLen = 15
 )
 
 type config struct {
 	pluginDirs       []string
 	pluginConfDir    string
+	pluginConfDirs   []string
+	cacheDir         string
 	pluginMaxConfNum int
 	prefix           string
+	ifNameFunc       IfNameFunc
+	idempotentSetup  bool
+	lenientLoad      bool
+	cleanupTimeout   time.Duration
+	// deduplicateNetworks drops duplicate networks instead of
+	// failing the load.
+	deduplicateNetworks bool
+	// defaultNetwork, defaultNetworkMarker and networkPriority select
+	// the order of the networks loaded from the config directory.
+	defaultNetwork       string
+	defaultNetworkMarker bool
+	networkPriority      []string
+	// confFileFilter and networkNameFilter select the files and
+	// networks loaded from the config directory.
+	confFileFilter    *nameFilter
+	networkNameFilter *nameFilter
+	// pluginInjections and confPatches are applied to the loaded networks.
+	pluginInjections []*PluginInjection
+	confPatches      []*ConfPatch
+	// cniVersionOverrides set the CNI version of the loaded networks.
+	cniVersionOverrides []*CNIVersionOverride
+	// confVars and confEnvVars expand the variables of the loaded
+	// network configs.
+	confVars    map[string]string
+	confEnvVars bool
+	// checkPlugins makes Status check the plugin binaries.
+	checkPlugins bool
+	// pluginAllowlist, if not nil, restricts the plugin binaries run.
+	pluginAllowlist *pluginAllowlist
+	// pluginEnv, if not nil, sets the environment of the plugins.
+	pluginEnv *PluginEnv
+	// pluginResources and pluginUsageFunc apply to the plugins run by
+	// the default executor.
+	pluginResources *PluginResources
+	pluginUsageFunc func(*PluginUsage)
+}
+
+// IfNameFunc returns the interface name of the network conf loaded
+// at index.
+type IfNameFunc func(index int, conf *cnilibrary.NetworkConfigList) string
+
+// confDirs returns the cni configuration directories, ordered
+// from the lowest to the highest precedence.
+func (c *config) confDirs() []string {
+	if len(c.pluginConfDirs) > 0 {
+		return c.pluginConfDirs
+	}
+	return []string{c.pluginConfDir}
 }
 
 type PortMapping struct {
@@ -18,8 +18,33 @@
 
 package cni
 
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
 const (
 	DefaultNetDir        = "/etc/cni/net.d"
 	DefaultCNIDir        = "/opt/cni/bin"
 	VendorCNIDirTemplate = "%s/opt/%s/bin"
 )
+
+// vendorCNIDir returns the plugin directory of vendor under root.
+func vendorCNIDir(root, vendor string) string {
+	return fmt.Sprintf(VendorCNIDirTemplate, root, vendor)
+}
+
+// fileInode returns the inode number of the file.
+func fileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+// pluginTypeFromPath returns the plugin type of the binary at path.
+func pluginTypeFromPath(path string) string {
+	return filepath.Base(path)
+}
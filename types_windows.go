@@ -18,7 +18,29 @@
 
 package cni
 
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
 const (
 	DefaultNetDir = "C:\\Program Files\\containerd\\cni\\conf"
 	DefaultCNIDir = "C:\\Program Files\\containerd\\cni\\bin"
 )
+
+// vendorCNIDir returns the plugin directory of vendor under root.
+func vendorCNIDir(root, vendor string) string {
+	return filepath.Join(root, "opt", vendor, "bin")
+}
+
+// fileInode returns 0, the file index is not exposed by os.FileInfo.
+func fileInode(os.FileInfo) uint64 {
+	return 0
+}
+
+// pluginTypeFromPath returns the plugin type of the binary at path.
+func pluginTypeFromPath(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}